@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+const adminSessionsPath = "/auth/admin/sessions"
+
+// AdminSessionList is the list of active sessions returned by the admin API
+type AdminSessionList struct {
+	Sessions []SessionRecord `json:"sessions"`
+}
+
+// RevokeInfo reports how many sessions a revocation request ended
+type RevokeInfo struct {
+	Revoked int `json:"revoked"`
+}
+
+// adminSessions serves the admin API of the portal sessions, which is only open to
+// the configured admin users:
+// - GET /auth/admin/sessions[?user=<keycloakid or username>] lists the sessions
+// - DELETE /auth/admin/sessions/<id> revokes a session
+// - DELETE /auth/admin/sessions?user=<keycloakid or username> revokes all the
+// sessions of a user
+// Revoked sessions are logged out of keycloak as well.
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	admin, ok := authorizeAdmin(w, r)
+
+	if !ok {
+
+		return
+
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, adminSessionsPath), "/")
+	user := r.URL.Query().Get("user")
+
+	switch {
+
+	case r.Method == http.MethodGet && id == "":
+
+		recs, e := findSessions(func(rec SessionRecord) bool {
+
+			return user == "" || rec.KeycloakID == user || rec.Username == user
+
+		})
+
+		if e != nil {
+
+			l.Error.Printf("[ADMIN] Error looking up sessions: %v\n", e)
+
+			writeJSONError(w, http.StatusInternalServerError, errCodeSessionError, "the sessions could not be looked up")
+
+			return
+
+		}
+
+		sort.Slice(recs, func(i, j int) bool { return recs[i].Created < recs[j].Created })
+
+		writeJSON(w, http.StatusOK, AdminSessionList{Sessions: append([]SessionRecord{}, recs...)})
+
+	case r.Method == http.MethodDelete && id != "":
+
+		recs, e := findSessions(func(rec SessionRecord) bool { return rec.ID == id })
+
+		if e != nil {
+
+			l.Error.Printf("[ADMIN] Error looking up session %v: %v\n", id, e)
+
+			writeJSONError(w, http.StatusInternalServerError, errCodeSessionError, "the session could not be looked up")
+
+			return
+
+		}
+
+		if len(recs) == 0 {
+
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "no such session")
+
+			return
+
+		}
+
+		revokeSessions(w, admin, recs)
+
+	case r.Method == http.MethodDelete && user != "":
+
+		recs, e := findSessions(func(rec SessionRecord) bool {
+
+			return rec.KeycloakID == user || rec.Username == user
+
+		})
+
+		if e != nil {
+
+			l.Error.Printf("[ADMIN] Error looking up the sessions of user [ %v ]: %v\n", user, e)
+
+			writeJSONError(w, http.StatusInternalServerError, errCodeSessionError, "the sessions could not be looked up")
+
+			return
+
+		}
+
+		revokeSessions(w, admin, recs)
+
+	case r.Method == http.MethodDelete:
+
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "a session id or a user must be given")
+
+	default:
+
+		w.Header().Set("Allow", "GET, DELETE")
+
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "the admin endpoint only accepts GET and DELETE requests")
+
+	}
+
+}
+
+// authorizeAdmin checks that the request comes from an authenticated session of an
+// admin user and returns the name of the admin; the API does not exist when no admin
+// user is configured. The admins are listed by keycloak id rather than derived from
+// the user's role, as the roles are held by the managers of every organization.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) (admin string, ok bool) {
+
+	if len(cfg.Session.AdminUsers) == 0 {
+
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "the admin api is not enabled")
+
+		return
+
+	}
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil {
+
+		l.Warning.Printf("[ADMIN] Error getting session: %v\n", e)
+
+	}
+
+	if !keepSessionAlive(w, r, s) {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session is not authenticated or has expired")
+
+		return
+
+	}
+
+	u := getPortalSession(s).User
+
+	admin = u.Username
+
+	if !isAdmin(u) {
+
+		l.Warning.Printf("[ADMIN] User [ %v ] who is not an admin tried to access %v %v\n", admin, r.Method, r.URL.Path)
+
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "only admin users can access this endpoint")
+
+		return
+
+	}
+
+	ok = true
+
+	return
+
+}
+
+// isAdmin tells whether the user is one of the configured admin users
+func isAdmin(u UserInfo) bool {
+
+	if u.ID == "" {
+
+		return false
+
+	}
+
+	for _, id := range cfg.Session.AdminUsers {
+
+		if id == u.ID {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+// revokeSessions revokes the given sessions and writes the number of sessions
+// revoked
+func revokeSessions(w http.ResponseWriter, admin string, recs []SessionRecord) {
+
+	for i, rec := range recs {
+
+		if e := revokeSession(rec.ID); e != nil {
+
+			l.Error.Printf("[ADMIN] Error revoking session %v: %v\n", rec.ID, e)
+
+			writeJSONError(w, http.StatusInternalServerError, errCodeSessionError, "not all sessions could be revoked")
+
+			return
+
+		}
+
+		l.Info.Printf("[ADMIN] User [ %v ] revoked session %v of user [ %v ] (%v of %v)\n", admin, rec.ID, rec.Username, i+1, len(recs))
+
+	}
+
+	writeJSON(w, http.StatusOK, RevokeInfo{Revoked: len(recs)})
+
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newUserSession saves an authenticated session of the user in the store and
+// returns its cookie; the session is added to the index
+func newUserSession(t *testing.T, u UserInfo) *http.Cookie {
+
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	s, _ := store.Get(r, sessionName)
+
+	setPortalSession(s, PortalSession{
+		Authenticated: true,
+		Created:       time.Now().Unix(),
+		LastSeen:      time.Now().Unix(),
+		User:          u,
+	})
+
+	if e := s.Save(r, w); e != nil {
+
+		t.Fatalf("saving the session: %v", e)
+
+	}
+
+	index.Add(SessionRecord{ID: s.ID, KeycloakID: u.ID, Username: u.Username, Role: u.Role, Created: time.Now().Unix()})
+
+	return w.Result().Cookies()[0]
+
+}
+
+func TestAdminSessionsRequiresAdminUser(t *testing.T) {
+
+	defer func(c sessionConfig) { cfg.Session = c }(cfg.Session)
+
+	cfg.Session.IdleTimeout = time.Hour
+	cfg.Session.MaxLifetime = 12 * time.Hour
+	cfg.Session.AdminUsers = []string{"admin-id"}
+
+	store = newTestServerStore(newMemoryBackend())
+	index = newLocalSessionIndex("")
+
+	admin := newUserSession(t, UserInfo{ID: "admin-id", Username: "admin", Role: "end_usr"})
+	manager := newUserSession(t, UserInfo{ID: "manager-id", Username: "manager", Role: "org_mgr"})
+
+	list := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+
+		r := httptest.NewRequest(http.MethodGet, adminSessionsPath, nil)
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+
+		FileServerMiddleware().ServeHTTP(w, r)
+
+		return w
+
+	}
+
+	if w := list(manager); w.Code != http.StatusForbidden {
+
+		t.Fatalf("organization manager listing the sessions: status %v, body %q; want 403", w.Code, w.Body.String())
+
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, adminSessionsPath+"?user=admin-id", nil)
+	r.AddCookie(manager)
+
+	w := httptest.NewRecorder()
+
+	FileServerMiddleware().ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+
+		t.Fatalf("organization manager revoking the sessions of the admin: status %v; want 403", w.Code)
+
+	}
+
+	w = list(admin)
+
+	var sessions AdminSessionList
+
+	if e := json.Unmarshal(w.Body.Bytes(), &sessions); w.Code != http.StatusOK || e != nil || len(sessions.Sessions) != 2 {
+
+		t.Fatalf("admin listing the sessions: status %v, body %q; want the 2 sessions", w.Code, w.Body.String())
+
+	}
+
+	cfg.Session.AdminUsers = nil
+
+	if w := list(admin); w.Code != http.StatusNotFound {
+
+		t.Fatalf("admin api without admin users: status %v; want 404", w.Code)
+
+	}
+
+}
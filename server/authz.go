@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strconv"
@@ -22,6 +23,10 @@ const (
 )
 
 var (
+	errKeycloakUnreachable = errors.New("unable to log in to keycloak")
+	errTokenInactive       = errors.New("token no longer valid")
+	errUserInfo            = errors.New("unable to get the user info")
+
 	//roles = []string{"lex_adm", "lex_sup", "org_mgr", "prj_mgr", "dat_mgr", "end_usr"}
 	roles = []string{"org_mgr", "prj_mgr", "dat_mgr", "end_usr"}
 )
@@ -42,10 +47,11 @@ type UserInfo struct {
 }
 
 // createOAuth2Config creates an OAuth2Config struct populated with the appropriate
-// data based on what is in the confiuration
-func createOauth2Config(c keycloakConfig) (returnConfig oauth2.Config) {
+// data based on what is in the confiuration; the OIDC provider obtained through
+// discovery is also returned as it is needed to verify the tokens it issues
+func createOauth2Config(c keycloakConfig) (returnConfig oauth2.Config, returnProvider *oidc.Provider) {
 
-	ctx := context.Background()
+	ctx := keycloakContext(context.Background())
 
 	keycloakService := getKeycloakService(c)
 
@@ -71,10 +77,50 @@ func createOauth2Config(c keycloakConfig) (returnConfig oauth2.Config) {
 		Scopes:       []string{oidc.ScopeOpenID}, //, "profile", "email", "roles"}, // "openid" is a required scope for OpenID Connect flows
 	}
 
+	returnProvider = provider
+
 	return
 
 }
 
+// keycloakContext returns a context carrying the http client used for keycloak, in
+// the way go-oidc and oauth2 expect it
+func keycloakContext(ctx context.Context) context.Context {
+
+	return oidc.ClientContext(ctx, KeycloakHTTPClient)
+
+}
+
+// newKeycloakClient returns a gocloak client for the configured keycloak which uses
+// the transport of the keycloak http client
+func newKeycloakClient() gocloak.GoCloak {
+
+	client := gocloak.NewClient(getKeycloakService(cfg.Keycloak))
+
+	client.RestyClient().SetTransport(KeycloakHTTPClient.Transport)
+
+	return client
+
+}
+
+// getEndSessionEndpoint returns the end session endpoint advertised by the provider
+// in its discovery document, if any
+func getEndSessionEndpoint(p *oidc.Provider) string {
+
+	var claims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+
+	if e := p.Claims(&claims); e != nil {
+
+		l.Warning.Printf("Error reading provider discovery claims: %v\n", e)
+
+	}
+
+	return claims.EndSessionEndpoint
+
+}
+
 // getKeycloaktService returns the keycloak service; note that there has to be exceptional
 // handling of port 80 and port 443
 func getKeycloakService(c keycloakConfig) (s string) {
@@ -104,38 +150,43 @@ func getUserInfo(token string) (u UserInfo, returnError error) {
 
 	l.Debug.Printf("[KEYCLOAK] Performing authentication check. Token [ ****%v... ]\n", token[:13])
 
-	keycloakService := getKeycloakService(cfg.Keycloak)
-	client := gocloak.NewClient(keycloakService)
+	client := newKeycloakClient()
 	ctx := context.Background()
 
-	_, e := client.LoginClient(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
+	// a public client cannot log in nor introspect tokens; in that case we rely on
+	// the userinfo endpoint rejecting tokens which are no longer valid
+	if cfg.Keycloak.ClientSecret != "" {
 
-	if e != nil {
+		_, e := client.LoginClient(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
 
-		l.Warning.Printf("[KEYCLOAK] Problems logging into keycloak. Error: %v\n", e)
-		returnError = errors.New("unable to log in to keycloak")
+		if e != nil {
 
-		return
+			l.Warning.Printf("[KEYCLOAK] Problems logging into keycloak. Error: %v\n", e)
+			returnError = errKeycloakUnreachable
 
-	}
+			return
 
-	retroinspection, e := client.RetrospectToken(ctx, token, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
+		}
 
-	if e != nil {
+		retroinspection, e := client.RetrospectToken(ctx, token, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
 
-		l.Warning.Printf("[KEYCLOAK] Problems retroinspecting the token. Error: %v\n", e)
-		returnError = errors.New("unable to retroinspect the token")
+		if e != nil {
 
-		return
+			l.Warning.Printf("[KEYCLOAK] Problems retroinspecting the token. Error: %v\n", e)
+			returnError = fmt.Errorf("unable to retroinspect the token - %w", errKeycloakUnreachable)
 
-	}
+			return
 
-	if !*retroinspection.Active {
+		}
 
-		l.Warning.Printf("[KEYCLOAK] The token seems to be no longer valid.\n")
-		returnError = errors.New("token no longer valid")
+		if !*retroinspection.Active {
 
-		return
+			l.Warning.Printf("[KEYCLOAK] The token seems to be no longer valid.\n")
+			returnError = errTokenInactive
+
+			return
+
+		}
 
 	}
 
@@ -144,7 +195,7 @@ func getUserInfo(token string) (u UserInfo, returnError error) {
 	if e != nil {
 
 		l.Warning.Printf("[KEYCLOAK] Problems retrieving the user info. Error: %v\n", e)
-		returnError = errors.New("unable to get the user info")
+		returnError = errUserInfo
 
 		return
 
@@ -152,28 +203,51 @@ func getUserInfo(token string) (u UserInfo, returnError error) {
 
 	u.Token = token
 
+	populateUserInfo(&u, attributes)
+
+	return
+
+}
+
+// getUserInfoFromClaims builds the user info from the claims of an already verified
+// ID token, saving the round trips to keycloak made by getUserInfo; this requires
+// the client to be configured to add the user attributes to the ID token
+func getUserInfoFromClaims(claims map[string]interface{}, token string) (u UserInfo) {
+
+	u.Token = token
+
+	populateUserInfo(&u, claims)
+
+	return
+
+}
+
+// populateUserInfo fills in the user info from the claims obtained from keycloak,
+// either from the userinfo endpoint or from the ID token
+func populateUserInfo(u *UserInfo, attributes map[string]interface{}) {
+
 	// end_usr for default role
 	u.Role = roles[len(roles)-1]
 
 	if attributes["sub"] != nil {
 
-		u.ID = attributes["sub"].(string)
-		u.EmailAddress = attributes["email"].(string)
-		u.EmailVerified = attributes["email_verified"].(bool)
-		u.Firstname = attributes["given_name"].(string)
-		u.Lastname = attributes["family_name"].(string)
-		u.Username = attributes["preferred_username"].(string)
+		u.ID, _ = attributes["sub"].(string)
+		u.EmailAddress, _ = attributes["email"].(string)
+		u.EmailVerified, _ = attributes["email_verified"].(bool)
+		u.Firstname, _ = attributes["given_name"].(string)
+		u.Lastname, _ = attributes["family_name"].(string)
+		u.Username, _ = attributes["preferred_username"].(string)
 
 	}
 
-	if attributes["attributes"] != nil {
+	if att, exists := attributes["attributes"].(map[string]interface{}); exists {
 
-		l.Warning.Printf("[KC<->UO] Attributes received from Keycloak for the user: %+v\n", attributes["attributes"])
+		l.Warning.Printf("[KC<->UO] Attributes received from Keycloak for the user: %+v\n", att)
 
-		u.Organization, u.Projects, u.DDIProjects = getIDs(attributes["attributes"].(map[string]interface{}))
-		u.Role = getRole(attributes["attributes"].(map[string]interface{}), u.Organization, strings.Join(u.Projects, " "))
+		u.Organization, u.Projects, u.DDIProjects = getIDs(att)
+		u.Role = getRole(att, u.Organization, strings.Join(u.Projects, " "))
 
-		u.Permissions = attributes["attributes"].(map[string]interface{})
+		u.Permissions = att
 
 	} else {
 
@@ -181,8 +255,6 @@ func getUserInfo(token string) (u UserInfo, returnError error) {
 
 	}
 
-	return
-
 }
 
 // getIDs job is to parse the attributes received from Keycloak and extract the
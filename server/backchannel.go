@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+const (
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	logoutTokenMaxAge      = 5 * time.Minute // logout tokens issued longer ago are rejected
+)
+
+// logoutClaims are the claims of a logout token as defined in the OpenID Connect
+// Back-Channel Logout specification
+type logoutClaims struct {
+	Events   map[string]interface{} `json:"events"`
+	Expiry   int64                  `json:"exp"`
+	IssuedAt int64                  `json:"iat"`
+	Nonce    *string                `json:"nonce"`
+	Sid      string                 `json:"sid"`
+	Subject  string                 `json:"sub"`
+}
+
+// backchannelLogout is called by keycloak when a user session ends at the provider
+// (eg an admin kills it); all the portal sessions belonging to the keycloak session
+// or, if no session is given, to the user are destroyed
+func backchannelLogout(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != http.MethodPost {
+
+		w.Header().Set("Allow", http.MethodPost)
+
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "the back-channel logout endpoint only accepts POST requests")
+
+		return
+
+	}
+
+	claims, e := verifyLogoutToken(r.Context(), r.PostFormValue("logout_token"))
+
+	if e != nil {
+
+		l.Warning.Printf("[BACKCHANNEL] Invalid logout token: %v\n", e)
+
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid logout token")
+
+		return
+
+	}
+
+	recs, e := findSessions(func(rec SessionRecord) bool {
+
+		if claims.Sid != "" {
+
+			return rec.KeycloakSession == claims.Sid && (claims.Subject == "" || rec.KeycloakID == claims.Subject)
+
+		}
+
+		return rec.KeycloakID == claims.Subject
+
+	})
+
+	if e != nil {
+
+		l.Error.Printf("[BACKCHANNEL] Error looking up sessions: %v\n", e)
+
+		writeJSONError(w, http.StatusBadRequest, errCodeSessionError, "the sessions could not be looked up")
+
+		return
+
+	}
+
+	for _, rec := range recs {
+
+		if e := destroySession(rec.ID); e != nil {
+
+			l.Error.Printf("[BACKCHANNEL] Error destroying session %v: %v\n", rec.ID, e)
+
+			writeJSONError(w, http.StatusBadRequest, errCodeSessionError, "not all sessions could be destroyed")
+
+			return
+
+		}
+
+	}
+
+	l.Info.Printf("[BACKCHANNEL] Logout for user [ %v ] keycloak session [ %v ]: %v portal session(s) destroyed\n", claims.Subject, claims.Sid, len(recs))
+
+	w.WriteHeader(http.StatusOK)
+
+}
+
+// verifyLogoutToken checks the signature, issuer and audience of a logout token with
+// the provider's keys and then validates the logout specific claims
+func verifyLogoutToken(ctx context.Context, rawToken string) (claims logoutClaims, returnErr error) {
+
+	if rawToken == "" {
+
+		returnErr = errors.New("no logout token in request")
+
+		return
+
+	}
+
+	// logout tokens are not required to carry an expiry, it is checked below
+	verifier := OIDCProvider.Verifier(&oidc.Config{ClientID: cfg.Keycloak.ClientID, SkipExpiryCheck: true})
+
+	token, e := verifier.Verify(ctx, rawToken)
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	if returnErr = token.Claims(&claims); returnErr != nil {
+
+		return
+
+	}
+
+	now := time.Now()
+
+	switch {
+
+	case claims.Events == nil || claims.Events[backchannelLogoutEvent] == nil:
+
+		returnErr = errors.New("logout token does not contain the back-channel logout event")
+
+	case claims.Nonce != nil:
+
+		returnErr = errors.New("logout token must not contain a nonce")
+
+	case claims.Subject == "" && claims.Sid == "":
+
+		returnErr = errors.New("logout token contains neither sub nor sid")
+
+	case claims.Expiry != 0 && time.Unix(claims.Expiry, 0).Before(now):
+
+		returnErr = errors.New("logout token expired")
+
+	case now.Sub(time.Unix(claims.IssuedAt, 0)) > logoutTokenMaxAge:
+
+		returnErr = errors.New("logout token issued too long ago")
+
+	}
+
+	return
+
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+)
+
+// setupProvider serves the discovery document and the keys of a test provider and
+// makes it the OIDCProvider of the portal; the returned function signs the given
+// claims as a token of the provider, with the key of the provider unless another
+// key is given
+func setupProvider(t *testing.T) (issuer string, sign func(claims map[string]interface{}, key *rsa.PrivateKey) string) {
+
+	t.Helper()
+
+	key, e := rsa.GenerateKey(rand.Reader, 2048)
+
+	if e != nil {
+
+		t.Fatalf("generating the key of the provider: %v", e)
+
+	}
+
+	mux := http.NewServeMux()
+
+	srv := httptest.NewServer(mux)
+
+	t.Cleanup(srv.Close)
+
+	issuer = srv.URL
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/certs",
+		})
+
+	})
+
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+
+	})
+
+	provider, keycloak := OIDCProvider, cfg.Keycloak
+
+	t.Cleanup(func() { OIDCProvider, cfg.Keycloak = provider, keycloak })
+
+	cfg.Keycloak.ClientID = "portal"
+
+	if OIDCProvider, e = oidc.NewProvider(context.Background(), issuer); e != nil {
+
+		t.Fatalf("creating the provider: %v", e)
+
+	}
+
+	sign = func(claims map[string]interface{}, signingKey *rsa.PrivateKey) string {
+
+		if signingKey == nil {
+
+			signingKey = key
+
+		}
+
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+		h := sha256.Sum256([]byte(signed))
+
+		sig, e := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, h[:])
+
+		if e != nil {
+
+			t.Fatalf("signing the token: %v", e)
+
+		}
+
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	}
+
+	return
+
+}
+
+func TestVerifyLogoutToken(t *testing.T) {
+
+	issuer, sign := setupProvider(t)
+
+	otherKey, e := rsa.GenerateKey(rand.Reader, 2048)
+
+	if e != nil {
+
+		t.Fatalf("generating another key: %v", e)
+
+	}
+
+	// claims returns the claims of a valid logout token with the given changes, a
+	// nil value removes the claim
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+
+		c := map[string]interface{}{
+			"iss":    issuer,
+			"aud":    "portal",
+			"iat":    time.Now().Unix(),
+			"jti":    "logout-1",
+			"sub":    "user-id",
+			"sid":    "keycloak-session",
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}
+
+		for k, v := range changes {
+
+			if v == nil {
+
+				delete(c, k)
+
+				continue
+
+			}
+
+			c[k] = v
+
+		}
+
+		return c
+
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid token", sign(claims(nil), nil), true},
+		{"sid only", sign(claims(map[string]interface{}{"sub": nil}), nil), true},
+		{"sub only", sign(claims(map[string]interface{}{"sid": nil}), nil), true},
+		{"unexpired token", sign(claims(map[string]interface{}{"exp": time.Now().Add(time.Minute).Unix()}), nil), true},
+		{"no token", "", false},
+		{"not a token", "logout", false},
+		{"signed with another key", sign(claims(nil), otherKey), false},
+		{"other issuer", sign(claims(map[string]interface{}{"iss": "https://evil.example.org"}), nil), false},
+		{"other audience", sign(claims(map[string]interface{}{"aud": "other-client"}), nil), false},
+		{"no events", sign(claims(map[string]interface{}{"events": nil}), nil), false},
+		{"other event", sign(claims(map[string]interface{}{"events": map[string]interface{}{"http://schemas.openid.net/event/other": map[string]interface{}{}}}), nil), false},
+		{"nonce", sign(claims(map[string]interface{}{"nonce": "n-0S6_WzA2Mj"}), nil), false},
+		{"neither sub nor sid", sign(claims(map[string]interface{}{"sub": nil, "sid": nil}), nil), false},
+		{"expired token", sign(claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}), nil), false},
+		{"stale token", sign(claims(map[string]interface{}{"iat": time.Now().Add(-logoutTokenMaxAge - time.Minute).Unix()}), nil), false},
+		{"no iat", sign(claims(map[string]interface{}{"iat": nil}), nil), false},
+	} {
+
+		got, e := verifyLogoutToken(context.Background(), tc.token)
+
+		if tc.valid && e != nil {
+
+			t.Errorf("%v: rejected: %v", tc.name, e)
+
+		}
+
+		if !tc.valid && e == nil {
+
+			t.Errorf("%v: accepted with claims %+v", tc.name, got)
+
+		}
+
+	}
+
+}
@@ -2,40 +2,137 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	l "gitlab.com/cyclops-utilities/logging"
 )
 
+// SameSite modes of the session cookie
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+	"strict": http.SameSiteStrictMode,
+}
+
+// PKCE modes supported in the keycloak configuration; off performs a plain
+// confidential client code flow, S256 adds a S256 code challenge to every login
+// and required additionally refuses callbacks without a code verifier, which also
+// allows the portal to run as a public client (without client secret)
+const (
+	pkceOff      = "off"
+	pkceS256     = "S256"
+	pkceRequired = "required"
+)
+
+// policies applied when a user logging in already has the maximum number of
+// sessions: reject refuses the login, evict ends the oldest sessions of the user
+const (
+	limitPolicyEvict  = "evict"
+	limitPolicyReject = "reject"
+)
+
 type generalConfig struct {
-	CertificateFile string `json:"certificate_file"`
-	CertificateKey  string `json:"certificate_key"`
-	FrontEndDir     string `json:"front_end_dir"`
-	HttpsEnabled    bool   `json:"https_enabled"`
-	LogFile         string `json:"log_file"`
-	LogLevel        string `json:"log_level"`
-	LogToConsole    bool   `json:"log_to_console"`
-	ServerPort      int    `json:"server_port"`
-	SessionDomain   string `json:"session_domain"`
-	SessionKey      string `json:"session_key"`
+	CertificateFile   string        `json:"certificate_file"`
+	CertificateKey    string        `json:"certificate_key"`
+	DrainPeriod       time.Duration `json:"drain_period"`
+	FrontEndDir       string        `json:"front_end_dir"`
+	HttpsEnabled      bool          `json:"https_enabled"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	LogFile           string        `json:"log_file"`
+	LogLevel          string        `json:"log_level"`
+	LogToConsole      bool          `json:"log_to_console"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	ServerPort        int           `json:"server_port"`
+	SessionDomain     string        `json:"session_domain"`
+	SessionKey        string        `json:"session_key"`
+	ShutdownTimeout   time.Duration `json:"shutdown_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
 }
 
 type keycloakConfig struct {
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Host         string `json:"host"`
-	Port         int    `json:"port"`
-	Realm        string `json:"realm"`
-	RedirectURL  string `json:"redirect_url"`
-	UseHttp      bool   `json:"use_http"`
+	ClientID               string   `json:"client_id"`
+	ClientSecret           string   `json:"client_secret"`
+	Host                   string   `json:"host"`
+	PKCE                   string   `json:"pkce"`
+	Port                   int      `json:"port"`
+	PostLogoutRedirectURL  string   `json:"post_logout_redirect_url"`
+	Realm                  string   `json:"realm"`
+	RedirectURL            string   `json:"redirect_url"`
+	RPLogout               bool     `json:"rp_logout"`
+	TokenExchangeAudiences []string `json:"token_exchange_audiences"`
+	UseHttp                bool     `json:"use_http"`
+	UseIDTokenClaims       bool     `json:"use_id_token_claims"`
+}
+
+type upstreamConfig struct {
+	Audience          string        `json:"audience"`
+	BreakerCooldown   time.Duration `json:"breaker_cooldown"`
+	BreakerThreshold  int           `json:"breaker_threshold"`
+	ConnectTimeout    time.Duration `json:"connect_timeout"`
+	Insecure          bool          `json:"insecure"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	Retries           int           `json:"retries"`
+	RetryBackoff      time.Duration `json:"retry_backoff"`
+	StreamIdleTimeout time.Duration `json:"stream_idle_timeout"`
+	URL               string        `json:"url"`
+}
+
+type proxyConfig struct {
+	MaxStreamsPerUser     int                       `json:"max_streams_per_user"`
+	TrustForwardedHeaders bool                      `json:"trust_forwarded_headers"`
+	Upstreams             map[string]upstreamConfig `json:"upstreams"`
+}
+
+type sessionConfig struct {
+	AdminUsers        []string      `json:"admin_users"`
+	Backend           string        `json:"backend"`
+	BlockKey          string        `json:"block_key"`
+	CookieDomain      string        `json:"cookie_domain"`
+	CookieHTTPOnly    bool          `json:"cookie_http_only"`
+	CookieMaxAge      time.Duration `json:"cookie_max_age"`
+	CookieName        string        `json:"cookie_name"`
+	CookiePath        string        `json:"cookie_path"`
+	CookieSameSite    string        `json:"cookie_same_site"`
+	CookieSecure      bool          `json:"cookie_secure"`
+	HashKey           string        `json:"hash_key"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	LimitPolicy       string        `json:"limit_policy"`
+	MaxDiskUsage      int64         `json:"max_disk_usage"`
+	MaxLifetime       time.Duration `json:"max_lifetime"`
+	MaxPerUser        int           `json:"max_per_user"`
+	PreviousBlockKeys []string      `json:"previous_block_keys"`
+	PreviousHashKeys  []string      `json:"previous_hash_keys"`
+	RedisAddress      string        `json:"redis_address"`
+	RedisDB           int           `json:"redis_db"`
+	RedisKeyPrefix    string        `json:"redis_key_prefix"`
+	RedisPassword     string        `json:"redis_password"`
+	SweepInterval     time.Duration `json:"sweep_interval"`
+	TokenVault        bool          `json:"token_vault"`
+	TokenVaultKey     string        `json:"token_vault_key"`
+}
+
+type tlsConfig struct {
+	CABundle          string `json:"ca_bundle"`
+	ClientCertificate string `json:"client_certificate"`
+	ClientKey         string `json:"client_key"`
+	KeycloakInsecure  bool   `json:"keycloak_insecure"`
+	MinVersion        string `json:"min_version"`
 }
 
 type configuration struct {
 	General  generalConfig  `json:"general"`
 	Keycloak keycloakConfig `json:"keycloak"`
+	Proxy    proxyConfig    `json:"proxy"`
+	Session  sessionConfig  `json:"session"`
+	TLS      tlsConfig      `json:"tls"`
 }
 
 // masked returns asterisks in place of string except for last um=nmakedChars chars
@@ -81,30 +178,612 @@ func parseConfig() (c configuration) {
 	c = configuration{
 
 		General: generalConfig{
-			CertificateFile: viper.GetString("general.certificatefile"),
-			CertificateKey:  viper.GetString("general.certificatekey"),
-			FrontEndDir:     viper.GetString("general.frontenddir"),
-			HttpsEnabled:    viper.GetBool("general.httpsenabled"),
-			LogFile:         viper.GetString("general.logfile"),
-			LogLevel:        viper.GetString("general.loglevel"),
-			LogToConsole:    viper.GetBool("general.logtoconsole"),
-			ServerPort:      viper.GetInt("general.serverport"),
-			SessionDomain:   viper.GetString("general.sessiondomain"),
-			SessionKey:      viper.GetString("general.sessionkey"),
+			CertificateFile:   viper.GetString("general.certificatefile"),
+			CertificateKey:    viper.GetString("general.certificatekey"),
+			DrainPeriod:       viper.GetDuration("general.drainperiod"),
+			FrontEndDir:       viper.GetString("general.frontenddir"),
+			HttpsEnabled:      viper.GetBool("general.httpsenabled"),
+			IdleTimeout:       viper.GetDuration("general.idletimeout"),
+			LogFile:           viper.GetString("general.logfile"),
+			LogLevel:          viper.GetString("general.loglevel"),
+			LogToConsole:      viper.GetBool("general.logtoconsole"),
+			ReadHeaderTimeout: viper.GetDuration("general.readheadertimeout"),
+			ReadTimeout:       viper.GetDuration("general.readtimeout"),
+			ServerPort:        viper.GetInt("general.serverport"),
+			SessionDomain:     viper.GetString("general.sessiondomain"),
+			SessionKey:        viper.GetString("general.sessionkey"),
+			ShutdownTimeout:   viper.GetDuration("general.shutdowntimeout"),
+			WriteTimeout:      viper.GetDuration("general.writetimeout"),
 		},
 
 		Keycloak: keycloakConfig{
-			ClientID:     viper.GetString("keycloak.clientid"),
-			ClientSecret: viper.GetString("keycloak.clientsecret"),
-			Host:         viper.GetString("keycloak.host"),
-			Port:         viper.GetInt("keycloak.port"),
-			Realm:        viper.GetString("keycloak.realm"),
-			RedirectURL:  viper.GetString("keycloak.redirecturl"),
-			UseHttp:      viper.GetBool("keycloak.usehttp"),
+			ClientID:               viper.GetString("keycloak.clientid"),
+			ClientSecret:           viper.GetString("keycloak.clientsecret"),
+			Host:                   viper.GetString("keycloak.host"),
+			PKCE:                   pkceMode(viper.GetString("keycloak.pkce")),
+			Port:                   viper.GetInt("keycloak.port"),
+			PostLogoutRedirectURL:  viper.GetString("keycloak.postlogoutredirecturl"),
+			Realm:                  viper.GetString("keycloak.realm"),
+			RedirectURL:            viper.GetString("keycloak.redirecturl"),
+			RPLogout:               viper.GetBool("keycloak.rplogout"),
+			TokenExchangeAudiences: viper.GetStringSlice("keycloak.tokenexchangeaudiences"),
+			UseHttp:                viper.GetBool("keycloak.usehttp"),
+			UseIDTokenClaims:       viper.GetBool("keycloak.useidtokenclaims"),
 		},
+
+		Proxy: proxyConfig{
+			MaxStreamsPerUser:     viper.GetInt("proxy.maxstreamsperuser"),
+			TrustForwardedHeaders: viper.GetBool("proxy.trustforwardedheaders"),
+			Upstreams:             parseUpstreams(),
+		},
+
+		Session: sessionConfig{
+			AdminUsers:        viper.GetStringSlice("session.adminusers"),
+			Backend:           viper.GetString("session.backend"),
+			BlockKey:          viper.GetString("session.blockkey"),
+			CookieDomain:      viper.GetString("session.cookiedomain"),
+			CookieHTTPOnly:    viper.GetBool("session.cookiehttponly"),
+			CookieMaxAge:      viper.GetDuration("session.cookiemaxage"),
+			CookieName:        viper.GetString("session.cookiename"),
+			CookiePath:        viper.GetString("session.cookiepath"),
+			CookieSameSite:    strings.ToLower(viper.GetString("session.cookiesamesite")),
+			CookieSecure:      viper.GetBool("session.cookiesecure"),
+			HashKey:           viper.GetString("session.hashkey"),
+			IdleTimeout:       viper.GetDuration("session.idletimeout"),
+			LimitPolicy:       strings.ToLower(viper.GetString("session.limitpolicy")),
+			MaxDiskUsage:      viper.GetInt64("session.maxdiskusage"),
+			MaxLifetime:       viper.GetDuration("session.maxlifetime"),
+			MaxPerUser:        viper.GetInt("session.maxperuser"),
+			PreviousBlockKeys: viper.GetStringSlice("session.previousblockkeys"),
+			PreviousHashKeys:  viper.GetStringSlice("session.previoushashkeys"),
+			RedisAddress:      viper.GetString("session.redisaddress"),
+			RedisDB:           viper.GetInt("session.redisdb"),
+			RedisKeyPrefix:    viper.GetString("session.rediskeyprefix"),
+			RedisPassword:     viper.GetString("session.redispassword"),
+			SweepInterval:     viper.GetDuration("session.sweepinterval"),
+			TokenVault:        viper.GetBool("session.tokenvault"),
+			TokenVaultKey:     viper.GetString("session.tokenvaultkey"),
+		},
+
+		TLS: tlsConfig{
+			CABundle:          viper.GetString("tls.cabundle"),
+			ClientCertificate: viper.GetString("tls.clientcertificate"),
+			ClientKey:         viper.GetString("tls.clientkey"),
+			KeycloakInsecure:  viper.GetBool("tls.keycloakinsecure"),
+			MinVersion:        viper.GetString("tls.minversion"),
+		},
+	}
+
+	// the defaults fit in the 10s docker waits before killing a stopping container
+	if !viper.IsSet("general.drainperiod") {
+
+		c.General.DrainPeriod = 3 * time.Second
+
+	}
+
+	if c.General.IdleTimeout == 0 {
+
+		c.General.IdleTimeout = 2 * time.Minute
+
+	}
+
+	if c.General.ReadHeaderTimeout == 0 {
+
+		c.General.ReadHeaderTimeout = 10 * time.Second
+
+	}
+
+	if c.General.ShutdownTimeout == 0 {
+
+		c.General.ShutdownTimeout = 5 * time.Second
+
+	}
+
+	if !viper.IsSet("proxy.maxstreamsperuser") {
+
+		c.Proxy.MaxStreamsPerUser = 10
+
+	}
+
+	if c.Session.Backend == "" {
+
+		c.Session.Backend = backendFilesystem
+
+	}
+
+	if c.Session.CookieDomain == "" {
+
+		c.Session.CookieDomain = c.General.SessionDomain
+
+	}
+
+	if !viper.IsSet("session.cookiehttponly") {
+
+		c.Session.CookieHTTPOnly = true
+
+	}
+
+	if c.Session.CookieName == "" {
+
+		c.Session.CookieName = "lexis-session"
+
+	}
+
+	if c.Session.CookiePath == "" {
+
+		c.Session.CookiePath = "/"
+
+	}
+
+	if c.Session.CookieSameSite == "" {
+
+		c.Session.CookieSameSite = "lax"
+
+	}
+
+	if !viper.IsSet("session.cookiesecure") {
+
+		c.Session.CookieSecure = true
+
+	}
+
+	// the general session key is the hash key of older configurations
+	if c.Session.HashKey == "" {
+
+		c.Session.HashKey = c.General.SessionKey
+
+	}
+
+	if c.Session.LimitPolicy == "" {
+
+		c.Session.LimitPolicy = limitPolicyEvict
+
+	}
+
+	if c.Session.IdleTimeout == 0 {
+
+		c.Session.IdleTimeout = time.Hour
+
+	}
+
+	if c.Session.MaxLifetime == 0 {
+
+		c.Session.MaxLifetime = 12 * time.Hour
+
+	}
+
+	// the cookie must live as long as the session can
+	if c.Session.CookieMaxAge == 0 {
+
+		c.Session.CookieMaxAge = c.Session.MaxLifetime
+
+	}
+
+	if !viper.IsSet("session.sweepinterval") {
+
+		c.Session.SweepInterval = 10 * time.Minute
+
+	}
+
+	if c.Session.RedisKeyPrefix == "" {
+
+		c.Session.RedisKeyPrefix = "lexis-portal:"
+
+	}
+
+	if c.TLS.MinVersion == "" {
+
+		c.TLS.MinVersion = "1.2"
+
+	}
+
+	return
+}
+
+// parseUpstreams reads the upstream services of the proxy, one table per service
+// under proxy.upstreams; viper lower cases the service names
+func parseUpstreams() (u map[string]upstreamConfig) {
+
+	u = make(map[string]upstreamConfig)
+
+	for name := range viper.GetStringMap("proxy.upstreams") {
+
+		key := "proxy.upstreams." + name
+
+		uc := upstreamConfig{
+			Audience:          viper.GetString(key + ".audience"),
+			BreakerCooldown:   viper.GetDuration(key + ".breakercooldown"),
+			BreakerThreshold:  viper.GetInt(key + ".breakerthreshold"),
+			ConnectTimeout:    viper.GetDuration(key + ".connecttimeout"),
+			Insecure:          viper.GetBool(key + ".insecure"),
+			ReadTimeout:       viper.GetDuration(key + ".readtimeout"),
+			Retries:           viper.GetInt(key + ".retries"),
+			RetryBackoff:      viper.GetDuration(key + ".retrybackoff"),
+			StreamIdleTimeout: viper.GetDuration(key + ".streamidletimeout"),
+			URL:               viper.GetString(key + ".url"),
+		}
+
+		if uc.BreakerCooldown == 0 {
+
+			uc.BreakerCooldown = 30 * time.Second
+
+		}
+
+		if !viper.IsSet(key + ".breakerthreshold") {
+
+			uc.BreakerThreshold = 5
+
+		}
+
+		if uc.ConnectTimeout == 0 {
+
+			uc.ConnectTimeout = 5 * time.Second
+
+		}
+
+		if uc.ReadTimeout == 0 {
+
+			uc.ReadTimeout = 30 * time.Second
+
+		}
+
+		if !viper.IsSet(key + ".retries") {
+
+			uc.Retries = 1
+
+		}
+
+		if uc.RetryBackoff == 0 {
+
+			uc.RetryBackoff = 200 * time.Millisecond
+
+		}
+
+		if uc.StreamIdleTimeout == 0 {
+
+			uc.StreamIdleTimeout = 5 * time.Minute
+
+		}
+
+		u[name] = uc
+
 	}
 
 	return
+
+}
+
+// pkceMode maps the PKCE mode in the configuration file to one of the supported
+// modes; the value is returned unchanged if it does not match any of them
+func pkceMode(s string) string {
+
+	switch strings.ToLower(s) {
+
+	case "", "off":
+
+		return pkceOff
+
+	case "s256":
+
+		return pkceS256
+
+	case "required":
+
+		return pkceRequired
+
+	}
+
+	return s
+
+}
+
+// validateConfig checks the configuration for settings which are invalid or which
+// do not make sense together
+func validateConfig(c configuration) (returnErr error) {
+
+	switch c.Keycloak.PKCE {
+
+	case pkceOff, pkceS256, pkceRequired:
+
+	default:
+
+		returnErr = fmt.Errorf("unknown keycloak pkce mode %q (valid modes are off, S256 and required)", c.Keycloak.PKCE)
+
+		return
+
+	}
+
+	if c.General.DrainPeriod < 0 || c.General.IdleTimeout < 0 || c.General.ReadHeaderTimeout < 0 || c.General.ReadTimeout < 0 || c.General.ShutdownTimeout < 0 || c.General.WriteTimeout < 0 {
+
+		returnErr = errors.New("general timeouts and drainperiod must not be negative")
+
+		return
+
+	}
+
+	switch c.Session.Backend {
+
+	case backendCookie, backendFilesystem, backendMemory:
+
+	case backendRedis:
+
+		if c.Session.RedisAddress == "" {
+
+			returnErr = errors.New("session redisaddress must be set for the redis backend")
+
+			return
+
+		}
+
+	default:
+
+		returnErr = fmt.Errorf("unknown session backend %q (valid backends are filesystem, cookie, redis and memory)", c.Session.Backend)
+
+		return
+
+	}
+
+	if e := validateCookie(c.Session); e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	if e := validateSessionKeys(c.Session, c.General.SessionKey); e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	switch c.Session.LimitPolicy {
+
+	case limitPolicyEvict, limitPolicyReject:
+
+	default:
+
+		returnErr = fmt.Errorf("unknown session limitpolicy %q (valid policies are evict and reject)", c.Session.LimitPolicy)
+
+		return
+
+	}
+
+	// the tokens of a logged in session alone take more than the 4KB of a cookie
+	if c.Session.Backend == backendCookie && !c.Session.TokenVault {
+
+		returnErr = errors.New("the cookie backend requires session tokenvault, the tokens of a session do not fit in the cookie")
+
+		return
+
+	}
+
+	if c.Session.TokenVault {
+
+		switch len(c.Session.TokenVaultKey) {
+
+		case 16, 24, 32:
+
+		default:
+
+			returnErr = fmt.Errorf("session tokenvaultkey is %v bytes long, it must be 16, 24 or 32 bytes long", len(c.Session.TokenVaultKey))
+
+			return
+
+		}
+
+	}
+
+	if c.Session.IdleTimeout < 0 || c.Session.MaxLifetime < c.Session.IdleTimeout {
+
+		returnErr = errors.New("session idletimeout must be positive and not longer than maxlifetime")
+
+		return
+
+	}
+
+	exchange := len(c.Keycloak.TokenExchangeAudiences) > 0
+
+	for _, a := range c.Keycloak.TokenExchangeAudiences {
+
+		if a == "" {
+
+			returnErr = errors.New("keycloak tokenexchangeaudiences must not contain empty audiences")
+
+			return
+
+		}
+
+	}
+
+	for name, u := range c.Proxy.Upstreams {
+
+		exchange = exchange || u.Audience != ""
+
+		target, e := url.Parse(u.URL)
+
+		if e != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+
+			returnErr = fmt.Errorf("proxy upstream %v has an invalid url %q", name, u.URL)
+
+			return
+
+		}
+
+		if u.ConnectTimeout < 0 || u.ReadTimeout < 0 || u.Retries < 0 || u.RetryBackoff < 0 || u.BreakerCooldown < 0 || u.StreamIdleTimeout < 0 {
+
+			returnErr = fmt.Errorf("proxy upstream %v has a negative timeout, retry or breaker setting", name)
+
+			return
+
+		}
+
+	}
+
+	if _, exists := tlsVersions[c.TLS.MinVersion]; !exists {
+
+		returnErr = fmt.Errorf("unsupported tls minversion %q (valid versions are 1.0, 1.1, 1.2 and 1.3)", c.TLS.MinVersion)
+
+		return
+
+	}
+
+	if (c.TLS.ClientCertificate == "") != (c.TLS.ClientKey == "") {
+
+		returnErr = errors.New("tls clientcertificate and clientkey must be set together")
+
+		return
+
+	}
+
+	if c.Keycloak.ClientSecret == "" && c.Keycloak.PKCE != pkceRequired {
+
+		returnErr = errors.New("keycloak pkce must be set to required when running as a public client (no client secret)")
+
+		return
+
+	}
+
+	// keycloak only lets confidential clients exchange tokens
+	if c.Keycloak.ClientSecret == "" && exchange {
+
+		returnErr = errors.New("token exchange (keycloak tokenexchangeaudiences or an upstream audience) requires a keycloak clientsecret")
+
+		return
+
+	}
+
+	return
+
+}
+
+// validateCookie checks the attributes of the session cookie, including the
+// requirements of the __Host- and __Secure- name prefixes which browsers enforce.
+// The max age of the cookie also bounds how long the stores keep the sessions, so
+// it must cover the idle timeout (the cookie is renewed with the activity) and has
+// no use beyond the max lifetime.
+func validateCookie(c sessionConfig) (returnErr error) {
+
+	if _, exists := sameSiteModes[c.CookieSameSite]; !exists {
+
+		returnErr = fmt.Errorf("unknown session cookiesamesite %q (valid values are lax, strict and none)", c.CookieSameSite)
+
+		return
+
+	}
+
+	switch {
+
+	case c.CookieMaxAge < time.Second:
+
+		returnErr = errors.New("session cookiemaxage must be at least 1s")
+
+	case c.CookieMaxAge < c.IdleTimeout:
+
+		returnErr = fmt.Errorf("session cookiemaxage (%v) must not be shorter than session idletimeout (%v)", c.CookieMaxAge, c.IdleTimeout)
+
+	case c.CookieMaxAge > c.MaxLifetime:
+
+		returnErr = fmt.Errorf("session cookiemaxage (%v) must not be longer than session maxlifetime (%v)", c.CookieMaxAge, c.MaxLifetime)
+
+	case c.CookieSameSite == "none" && !c.CookieSecure:
+
+		returnErr = errors.New("session cookiesamesite none requires cookiesecure")
+
+	case strings.HasPrefix(c.CookieName, "__Host-") && (!c.CookieSecure || c.CookiePath != "/" || c.CookieDomain != ""):
+
+		returnErr = errors.New("a __Host- session cookie requires cookiesecure, cookiepath / and no cookiedomain (nor general sessiondomain)")
+
+	case strings.HasPrefix(c.CookieName, "__Secure-") && !c.CookieSecure:
+
+		returnErr = errors.New("a __Secure- session cookie requires cookiesecure")
+
+	}
+
+	return
+
+}
+
+// validateSessionKeys checks the length of the session keys: hash keys must have at
+// least 32 bytes and block keys, which are optional, 16, 24 or 32 bytes to select
+// AES-128, AES-192 or AES-256. A hash key may be shorter when it is the legacy
+// general session key, so that older configurations keep working and can move to
+// a new hash key with the old one as a previous key (see weakLegacyHashKey).
+func validateSessionKeys(c sessionConfig, legacyKey string) (returnErr error) {
+
+	if len(c.PreviousBlockKeys) > len(c.PreviousHashKeys) {
+
+		returnErr = errors.New("session previousblockkeys has more keys than previoushashkeys")
+
+		return
+
+	}
+
+	hashKeys := append([]string{c.HashKey}, c.PreviousHashKeys...)
+	blockKeys := append([]string{c.BlockKey}, c.PreviousBlockKeys...)
+
+	for i, k := range hashKeys {
+
+		if k != "" && k == legacyKey {
+
+			continue
+
+		}
+
+		if len(k) < 32 {
+
+			returnErr = fmt.Errorf("session hash key %v is %v bytes long, at least 32 bytes are required", i, len(k))
+
+			return
+
+		}
+
+	}
+
+	for i, k := range blockKeys {
+
+		switch len(k) {
+
+		case 0, 16, 24, 32:
+
+		default:
+
+			returnErr = fmt.Errorf("session block key %v is %v bytes long, it must be 16, 24 or 32 bytes long", i, len(k))
+
+			return
+
+		}
+
+	}
+
+	return
+
+}
+
+// weakLegacyHashKey returns true if the current or a previous hash key is a general
+// session key shorter than the 32 bytes required of session hash keys
+func weakLegacyHashKey(c configuration) bool {
+
+	if c.General.SessionKey == "" || len(c.General.SessionKey) >= 32 {
+
+		return false
+
+	}
+
+	for _, k := range append([]string{c.Session.HashKey}, c.Session.PreviousHashKeys...) {
+
+		if k == c.General.SessionKey {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
 }
 
 // dumpConfig dumps the configuration in json format to the log system
@@ -115,6 +794,24 @@ func dumpConfig(c configuration) {
 	// deal with configuration params that should be masked
 	cfgCopy.General.SessionKey = masked(c.General.SessionKey, 4)
 	cfgCopy.Keycloak.ClientSecret = masked(c.Keycloak.ClientSecret, 4)
+	cfgCopy.Session.BlockKey = masked(c.Session.BlockKey, 0)
+	cfgCopy.Session.HashKey = masked(c.Session.HashKey, 4)
+	cfgCopy.Session.PreviousBlockKeys = make([]string, len(c.Session.PreviousBlockKeys))
+	cfgCopy.Session.PreviousHashKeys = make([]string, len(c.Session.PreviousHashKeys))
+	cfgCopy.Session.RedisPassword = masked(c.Session.RedisPassword, 0)
+	cfgCopy.Session.TokenVaultKey = masked(c.Session.TokenVaultKey, 0)
+
+	for i, k := range c.Session.PreviousBlockKeys {
+
+		cfgCopy.Session.PreviousBlockKeys[i] = masked(k, 0)
+
+	}
+
+	for i, k := range c.Session.PreviousHashKeys {
+
+		cfgCopy.Session.PreviousHashKeys[i] = masked(k, 4)
+
+	}
 
 	// mmrshalindent creates a string containing newlines; each line starts with
 	// two spaces and two spaces are added for each indent...
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// error codes passed to the front end's error page when a login fails; the front
+// end relies on them, so existing codes must not be changed
+const (
+	loginErrExchangeFailed      = "exchange_failed"
+	loginErrIDTokenInvalid      = "id_token_invalid"
+	loginErrInternal            = "internal_error"
+	loginErrKeycloakUnreachable = "keycloak_unreachable"
+	loginErrPKCEMissing         = "pkce_verifier_missing"
+	loginErrProvider            = "provider_error"
+	loginErrSessionFailed       = "session_error"
+	loginErrSessionLimit        = "session_limit"
+	loginErrSessionTooLarge     = "session_too_large"
+	loginErrStateExpired        = "state_expired"
+	loginErrStateInvalid        = "state_invalid"
+	loginErrTokenInactive       = "token_inactive"
+	loginErrUserInfoFailed      = "user_info_failed"
+)
+
+// loginError is a failure in the login flow, carrying the code that is reported to
+// the front end together with the underlying error
+type loginError struct {
+	Code string
+	Err  error
+}
+
+func (e *loginError) Error() string {
+
+	return e.Code + ": " + e.Err.Error()
+
+}
+
+func (e *loginError) Unwrap() error {
+
+	return e.Err
+
+}
+
+// newLoginError wraps an error of the login flow with its error code
+func newLoginError(code string, e error) error {
+
+	return &loginError{Code: code, Err: e}
+
+}
+
+// userInfoErrorCode maps the errors returned by getUserInfo to login error codes
+func userInfoErrorCode(e error) string {
+
+	switch {
+
+	case errors.Is(e, errKeycloakUnreachable):
+
+		return loginErrKeycloakUnreachable
+
+	case errors.Is(e, errTokenInactive):
+
+		return loginErrTokenInactive
+
+	}
+
+	return loginErrUserInfoFailed
+
+}
+
+// loginFailed logs a failed login under a new correlation ID and redirects the
+// browser to the front end's error page with the error code and correlation ID, so
+// that what the user reports can be matched with the logs
+func loginFailed(w http.ResponseWriter, r *http.Request, e error) {
+
+	code := loginErrInternal
+
+	var le *loginError
+
+	if errors.As(e, &le) {
+
+		code = le.Code
+
+	}
+
+	id, re := randomString(12)
+
+	if re != nil {
+
+		id = "unknown"
+
+	}
+
+	l.Warning.Printf("[LOGIN] Login failed [ code: %v, correlation id: %v, path: %v ]: %v\n", code, id, r.URL.Path, e)
+
+	q := url.Values{}
+
+	q.Set("code", code)
+	q.Set("id", id)
+
+	w.Header().Set("X-Correlation-ID", id)
+
+	http.Redirect(w, r, "/error?"+q.Encode(), http.StatusFound)
+
+}
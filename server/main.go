@@ -1,14 +1,12 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
 
-	"github.com/gorilla/sessions"
+	"github.com/coreos/go-oidc"
 	l "gitlab.com/cyclops-utilities/logging"
 	"golang.org/x/oauth2"
 )
@@ -17,16 +15,27 @@ var (
 	cfg         configuration
 	version     string
 	serviceName = "Lexis Portal"
-	state       = "foobar" // this should not be a global but is currently for testing..
 
-	Oauth2Config oauth2.Config
-	sessionDir   = "./sessions"
-	store        *sessions.FilesystemStore
-	sessionName  = "lexis-session"
+	Oauth2Config       oauth2.Config
+	OIDCProvider       *oidc.Provider
+	IDTokenVerifier    *oidc.IDTokenVerifier
+	EndSessionEndpoint string
+	KeycloakHTTPClient *http.Client
+	sessionDir         = "./sessions"
+	store              portalStore
+	vault              *tokenVault
+	index              sessionIndex
+	upstreams          map[string]*upstream
+	streams            *streamLimiter
+	sweeper            *sessionSweeper
+	exchanges          *exchangeCache
+	sessionName        = "lexis-session" // name of the session cookie, see session.cookiename
 )
 
-// init function - reads in configuration file and creates logger
-func init() {
+// initialize reads in the configuration file, creates the logger and sets up the
+// clients and stores of the portal; it is called by main rather than run as init, so
+// that the package can be tested without a configuration file
+func initialize() {
 
 	confFile := flag.String("conf", "./config", "configuration file path (without toml extension)")
 
@@ -45,15 +54,78 @@ func init() {
 
 	cfg = parseConfig()
 
-	// when communicating with other services, they may not be secured with valid Https
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if e := validateConfig(cfg); e != nil {
 
-	Oauth2Config = createOauth2Config(cfg.Keycloak)
+		fmt.Printf("Invalid configuration. Error: %v.\n", e)
 
-	createSessionStore()
+		os.Exit(1)
+
+	}
+
+	sessionName = cfg.Session.CookieName
+
+	// all the communication with keycloak (oidc discovery, token exchange, introspection,
+	// ...) goes through this client
+	keycloakClient, e := newHTTPClient(cfg.TLS, cfg.TLS.KeycloakInsecure)
+
+	if e != nil {
+
+		fmt.Printf("Error creating the keycloak http client. Error: %v.\n", e)
+
+		os.Exit(1)
+
+	}
+
+	if cfg.TLS.KeycloakInsecure {
+
+		l.Warning.Printf("Certificate verification for keycloak is disabled - do not use in production scenario...\n")
+
+	}
+
+	KeycloakHTTPClient = keycloakClient
+
+	Oauth2Config, OIDCProvider = createOauth2Config(cfg.Keycloak)
+
+	// checks the signature, issuer, audience and expiry of the ID tokens
+	IDTokenVerifier = OIDCProvider.Verifier(&oidc.Config{ClientID: cfg.Keycloak.ClientID})
+
+	EndSessionEndpoint = getEndSessionEndpoint(OIDCProvider)
+
+	if e := createSessionStore(); e != nil {
+
+		fmt.Printf("Error creating the session store. Error: %v.\n", e)
+
+		os.Exit(1)
+
+	}
 
 	l.InitLogger(cfg.General.LogFile, cfg.General.LogLevel, cfg.General.LogToConsole)
 
+	if weakLegacyHashKey(cfg) {
+
+		l.Warning.Printf("[CONFIG] The general sessionkey signing the sessions is shorter than 32 bytes - set a session hashkey of at least 32 bytes, list the old key in session previoushashkeys and remove general sessionkey once the old sessions have expired...\n")
+
+	}
+
+	if upstreams, e = newUpstreams(cfg.Proxy, cfg.TLS); e != nil {
+
+		l.Error.Printf("Error creating the proxy upstreams. Error: %v.\n", e)
+
+		os.Exit(1)
+
+	}
+
+	streams = newStreamLimiter(cfg.Proxy.MaxStreamsPerUser)
+
+	exchanges = newExchangeCache()
+
+	// files of the filesystem backend are never removed by the gorilla store
+	if fs, ok := store.(*filesystemStore); ok && cfg.Session.SweepInterval > 0 {
+
+		sweeper = startSessionSweeper(fs, cfg.Session.SweepInterval, cfg.Session.MaxDiskUsage)
+
+	}
+
 	dumpConfig(cfg)
 
 	l.Info.Printf("%v version %v initialized", serviceName, version)
@@ -63,23 +135,32 @@ func init() {
 // main function creates the database connection and launches the endpoint handlers
 func main() {
 
-	f := FileServerMiddleware()
+	initialize()
 
 	// note that this runs on all interfaces right now
-	serviceLocation := ":" + strconv.Itoa(cfg.General.ServerPort)
+	server := newServer(cfg.General, FileServerMiddleware())
+
+	l.Info.Printf("Starting to serve %v, access server on http://localhost:%v\n", serviceName, server.Addr)
 
-	l.Info.Printf("Starting to serve %v, access server on http://localhost:%v\n", serviceName, serviceLocation)
+	if !cfg.General.HttpsEnabled {
 
-	// Run the standard http server
-	if cfg.General.HttpsEnabled {
+		l.Warning.Printf("Running without TLS security - do not use in production scenario...")
 
-		l.Error.Printf((http.ListenAndServeTLS(serviceLocation, cfg.General.CertificateFile, cfg.General.CertificateKey, f)).Error())
+	}
 
-	} else {
+	e := serve(server, cfg.General)
 
-		l.Warning.Printf("Running without TLS security - do not use in production scenario...")
+	if e != nil {
+
+		l.Error.Printf("Error running the server: %v\n", e)
+
+	}
+
+	stopPortal()
+
+	if e != nil {
 
-		l.Error.Printf((http.ListenAndServe(serviceLocation, f)).Error())
+		os.Exit(1)
 
 	}
 
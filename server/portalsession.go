@@ -0,0 +1,252 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/sessions"
+	l "gitlab.com/cyclops-utilities/logging"
+	"golang.org/x/oauth2"
+)
+
+const (
+	portalSessionKey     = "portal" // key of the PortalSession in the values of the gorilla session
+	portalSessionVersion = 1        // layout of the PortalSession, older sessions are migrated when read
+)
+
+// keys under which the values of a session were stored before the PortalSession was
+// introduced (version 0)
+var legacySessionKeys = []string{
+	"authenticated", "created", "ddi-projects", "email", "emailverified", "firstname",
+	"idToken", "keycloakid", "lastname", "lastseen", "pending-logins", "permissions",
+	"refToken", "role", "token", "tokenexpiry", "username",
+}
+
+// PortalSession is the state the portal keeps in a session. It is stored as a whole
+// under a single key of the gorilla session, so that every field has a type and a
+// missing session reads as the zero value, ie an unauthenticated session.
+type PortalSession struct {
+	Version       int
+	Authenticated bool
+	User          UserInfo
+	Tokens        sessionTokens // only used when the token vault is disabled
+	TokenExpiry   int64         // unix time, 0 if unknown
+	Created       int64         // unix time of the login
+	LastSeen      int64         // unix time of the last activity
+	PendingLogins map[string]PendingLogin
+}
+
+// getPortalSession decodes the portal session from a gorilla session, migrating the
+// sessions written by older versions of the portal
+func getPortalSession(s *sessions.Session) (ps PortalSession) {
+
+	v, exists := s.Values[portalSessionKey]
+
+	if !exists {
+
+		return migrateLegacySession(s)
+
+	}
+
+	ps, ok := v.(PortalSession)
+
+	if !ok {
+
+		l.Warning.Printf("[SESSION] Session %v holds an invalid portal session of type %T, ignoring it\n", s.ID, v)
+
+		return PortalSession{Version: portalSessionVersion}
+
+	}
+
+	// migrations of later layouts go here, from the oldest to the newest
+
+	return
+
+}
+
+// setPortalSession encodes the portal session into a gorilla session; the session
+// still has to be saved
+func setPortalSession(s *sessions.Session, ps PortalSession) {
+
+	ps.Version = portalSessionVersion
+
+	// the token of the user info is only used while building it
+	ps.User.Token = ""
+
+	s.Values[portalSessionKey] = ps
+
+	for _, k := range legacySessionKeys {
+
+		delete(s.Values, k)
+
+	}
+
+}
+
+// migrateLegacySession reads a session written before the PortalSession was
+// introduced, where every field had its own key; values of an unexpected type are
+// ignored
+func migrateLegacySession(s *sessions.Session) (ps PortalSession) {
+
+	ps.Version = portalSessionVersion
+
+	ps.Authenticated, _ = s.Values["authenticated"].(bool)
+	ps.Created, _ = s.Values["created"].(int64)
+	ps.LastSeen, _ = s.Values["lastseen"].(int64)
+	ps.TokenExpiry, _ = s.Values["tokenexpiry"].(int64)
+	ps.PendingLogins, _ = s.Values["pending-logins"].(map[string]PendingLogin)
+
+	ps.User.DDIProjects, _ = s.Values["ddi-projects"].([]string)
+	ps.User.EmailAddress, _ = s.Values["email"].(string)
+	ps.User.Firstname, _ = s.Values["firstname"].(string)
+	ps.User.ID, _ = s.Values["keycloakid"].(string)
+	ps.User.Lastname, _ = s.Values["lastname"].(string)
+	ps.User.Permissions, _ = s.Values["permissions"].(map[string]interface{})
+	ps.User.Role, _ = s.Values["role"].(string)
+	ps.User.Username, _ = s.Values["username"].(string)
+
+	// the flag was stored as a bool, but cleared as a string
+	switch v := s.Values["emailverified"].(type) {
+
+	case bool:
+
+		ps.User.EmailVerified = v
+
+	case string:
+
+		ps.User.EmailVerified = v == "true"
+
+	}
+
+	ps.Tokens.AccessToken, _ = s.Values["token"].(string)
+	ps.Tokens.IDToken, _ = s.Values["idToken"].(string)
+	ps.Tokens.RefreshToken, _ = s.Values["refToken"].(string)
+
+	return
+
+}
+
+// getTokens returns the tokens of the session with the given ID, from the token
+// vault if it is enabled; empty tokens are returned if the session has none
+func (ps *PortalSession) getTokens(id string) sessionTokens {
+
+	if vault != nil && id != "" {
+
+		tokens, e := vault.get(id)
+
+		if e == nil {
+
+			return tokens
+
+		}
+
+		if e != errSessionNotFound {
+
+			l.Warning.Printf("[SESSION] Error reading the tokens of session %v from the vault: %v\n", id, e)
+
+		}
+
+	}
+
+	return ps.Tokens
+
+}
+
+// setTokens stores the tokens obtained from the openid provider for the session with
+// the given ID, in the token vault if it is enabled, together with the expiry of the
+// access token; the ID token is only replaced if the response contains a new one
+func (ps *PortalSession) setTokens(id string, t *oauth2.Token) error {
+
+	tokens := sessionTokens{
+		AccessToken:  t.AccessToken,
+		IDToken:      ps.getTokens(id).IDToken,
+		RefreshToken: t.RefreshToken,
+	}
+
+	if idToken, ok := t.Extra("id_token").(string); ok && idToken != "" {
+
+		tokens.IDToken = idToken
+
+	}
+
+	ps.TokenExpiry = t.Expiry.Unix()
+
+	if vault == nil {
+
+		ps.Tokens = tokens
+
+		return nil
+
+	}
+
+	// tokens of sessions created before the vault was enabled are moved to it
+	ps.Tokens = sessionTokens{}
+
+	return vault.put(id, tokens)
+
+}
+
+// clearTokens removes the tokens of the session with the given ID, from the token
+// vault as well
+func (ps *PortalSession) clearTokens(id string) {
+
+	ps.Tokens = sessionTokens{}
+	ps.TokenExpiry = 0
+
+	if vault != nil && id != "" {
+
+		if e := vault.remove(id); e != nil {
+
+			l.Warning.Printf("[SESSION] Error removing the tokens of session %v from the vault: %v\n", id, e)
+
+		}
+
+	}
+
+}
+
+// tokenExpiry returns the expiry of the access token; the zero time is returned for
+// sessions which were created without tracking the expiry
+func (ps *PortalSession) tokenExpiry() time.Time {
+
+	if ps.TokenExpiry > 0 {
+
+		return time.Unix(ps.TokenExpiry, 0)
+
+	}
+
+	return time.Time{}
+
+}
+
+// expiry returns the time at which an authenticated session ends: after the idle
+// timeout without activity, or at the end of its absolute lifetime. Sessions created
+// before the timestamps were introduced are treated as if they were set now.
+func (ps *PortalSession) expiry() time.Time {
+
+	now := time.Now()
+	created, lastSeen := now, now
+
+	if ps.Created > 0 {
+
+		created = time.Unix(ps.Created, 0)
+
+	}
+
+	if ps.LastSeen > 0 {
+
+		lastSeen = time.Unix(ps.LastSeen, 0)
+
+	}
+
+	idle := lastSeen.Add(cfg.Session.IdleTimeout)
+	absolute := created.Add(cfg.Session.MaxLifetime)
+
+	if idle.Before(absolute) {
+
+		return idle
+
+	}
+
+	return absolute
+
+}
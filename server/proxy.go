@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// requests to /api/<service>/... are proxied to the upstream configured for service
+const proxyPathPrefix = "/api/"
+
+// upstream is a backend service which the front end reaches through the portal; the
+// portal authenticates the requests with the access token of the session, so that
+// the tokens do not have to be handed to the browser
+type upstream struct {
+	name     string
+	target   *url.URL
+	audience string // audience of the tokens sent to the service, empty to send the session's token
+	breaker  *circuitBreaker
+	proxy    *httputil.ReverseProxy
+}
+
+// newUpstream creates the proxy to the service at target, going through the given
+// transport with the retry and circuit breaker policies of the configuration
+func newUpstream(name string, target *url.URL, transport *http.Transport, uc upstreamConfig) *upstream {
+
+	u := &upstream{
+		name:     name,
+		target:   target,
+		audience: uc.Audience,
+		breaker:  newCircuitBreaker(uc.BreakerThreshold, uc.BreakerCooldown),
+	}
+
+	u.proxy = &httputil.ReverseProxy{
+		Director:      u.direct,
+		ErrorHandler:  u.proxyError,
+		FlushInterval: -1, // responses are streamed to the browser as they come
+		Transport: &policyTransport{
+			base:      transport,
+			streaming: newStreamingTransport(transport, uc.StreamIdleTimeout),
+			breaker:   u.breaker,
+			retries:   uc.Retries,
+			backoff:   uc.RetryBackoff,
+		},
+
+		// upstream cookies would be set on the portal's domain
+		ModifyResponse: func(resp *http.Response) error {
+
+			resp.Header.Del("Set-Cookie")
+
+			// the front end reaches the upstreams on the portal's origin, the cors
+			// headers of the upstreams would only open them to other sites
+			for k := range resp.Header {
+
+				if strings.HasPrefix(k, "Access-Control-") {
+
+					resp.Header.Del(k)
+
+				}
+
+			}
+
+			return nil
+
+		},
+	}
+
+	return u
+
+}
+
+// newUpstreams creates the proxies to the configured upstream services
+func newUpstreams(c proxyConfig, t tlsConfig) (map[string]*upstream, error) {
+
+	upstreams := make(map[string]*upstream)
+
+	for name, uc := range c.Upstreams {
+
+		target, e := url.Parse(uc.URL)
+
+		if e != nil {
+
+			return nil, fmt.Errorf("invalid url of upstream %v - %v", name, e)
+
+		}
+
+		// the client certificate is the portal's credential for keycloak, it is not
+		// presented to the upstreams
+		ut := t
+		ut.ClientCertificate, ut.ClientKey = "", ""
+
+		transport, e := newTransport(ut, uc.Insecure)
+
+		if e != nil {
+
+			return nil, fmt.Errorf("unable to create the transport of upstream %v - %v", name, e)
+
+		}
+
+		// the read timeout only covers the wait for the response headers, so that
+		// streamed responses are not cut
+		transport.DialContext = (&net.Dialer{
+			Timeout:   uc.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.ResponseHeaderTimeout = uc.ReadTimeout
+
+		if uc.Insecure {
+
+			l.Warning.Printf("[PROXY] Certificate verification for upstream %v is disabled - do not use in production scenario...\n", name)
+
+		}
+
+		upstreams[name] = newUpstream(name, target, transport, uc)
+
+	}
+
+	return upstreams, nil
+
+}
+
+// direct rewrites a request of the front end into a request to the upstream; the
+// path of the request has already been stripped of the /api/<service> prefix
+func (u *upstream) direct(r *http.Request) {
+
+	rawPath := strings.TrimSuffix(u.target.EscapedPath(), "/") + r.URL.EscapedPath()
+
+	p, e := url.PathUnescape(rawPath)
+
+	if e != nil {
+
+		p = rawPath
+
+	}
+
+	r.URL.Scheme = u.target.Scheme
+	r.URL.Host = u.target.Host
+	r.URL.Path = p
+	r.URL.RawPath = rawPath
+	r.Host = u.target.Host
+
+	switch {
+
+	case u.target.RawQuery == "":
+
+	case r.URL.RawQuery == "":
+
+		r.URL.RawQuery = u.target.RawQuery
+
+	default:
+
+		r.URL.RawQuery = u.target.RawQuery + "&" + r.URL.RawQuery
+
+	}
+
+	// keeps the reverse proxy from adding a default user agent
+	if _, exists := r.Header["User-Agent"]; !exists {
+
+		r.Header.Set("User-Agent", "")
+
+	}
+
+}
+
+// proxyError answers a request which could not be proxied
+func (u *upstream) proxyError(w http.ResponseWriter, r *http.Request, e error) {
+
+	switch {
+
+	case errors.Is(e, errCircuitOpen):
+
+		l.Debug.Printf("[PROXY] Circuit breaker of upstream %v open, failing %v %v\n", u.name, r.Method, r.URL.Path)
+
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(u.breaker.retryIn().Seconds())+1, 10))
+
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeUpstreamCircuitOpen, "the service "+u.name+" is unavailable, retry later")
+
+	case errors.Is(e, context.Canceled):
+
+		l.Debug.Printf("[PROXY] Request %v %v to upstream %v cancelled by the client\n", r.Method, r.URL.Path, u.name)
+
+		w.WriteHeader(http.StatusBadGateway)
+
+	case isTimeout(e):
+
+		l.Warning.Printf("[PROXY] Timeout proxying %v %v to upstream %v: %v\n", r.Method, r.URL.Path, u.name, e)
+
+		writeJSONError(w, http.StatusGatewayTimeout, errCodeUpstreamTimeout, "the service "+u.name+" did not answer in time")
+
+	default:
+
+		l.Warning.Printf("[PROXY] Error proxying %v %v to upstream %v: %v\n", r.Method, r.URL.Path, u.name, e)
+
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamUnavailable, "the service "+u.name+" could not be reached")
+
+	}
+
+}
+
+// proxyRequest proxies a request of the front end to /api/<service>/... to the
+// upstream of the service. The request must belong to an authenticated session; the
+// access token of the session, refreshed if needed, replaces the credentials of the
+// browser (cookies are not passed on). For services with an audience, the token is
+// first exchanged for one restricted to that audience.
+func proxyRequest(w http.ResponseWriter, r *http.Request) {
+
+	name, rest := splitProxyPath(r.URL.EscapedPath())
+
+	u, exists := upstreams[name]
+
+	if !exists {
+
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "no such service")
+
+		return
+
+	}
+
+	if !sameOrigin(r) {
+
+		l.Warning.Printf("[PROXY] Cross origin %v request to upstream %v from %v rejected\n", r.Method, name, r.Header.Get("Origin"))
+
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "cross origin requests are not allowed")
+
+		return
+
+	}
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil {
+
+		l.Warning.Printf("[PROXY] Error getting session: %v\n", e)
+
+	}
+
+	if !keepSessionAlive(w, r, s) || !ensureFreshToken(w, r, s) {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session is not authenticated or has expired")
+
+		return
+
+	}
+
+	token := getSessionTokens(s).AccessToken
+
+	if token == "" {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session has no access token")
+
+		return
+
+	}
+
+	if u.audience != "" {
+
+		t, e := audienceToken(keycloakContext(r.Context()), token, u.audience)
+
+		if e != nil {
+
+			writeExchangeError(w, u.audience, e)
+
+			return
+
+		}
+
+		token = t.accessToken
+
+	}
+
+	if isStreaming(r) {
+
+		user := getPortalSession(s).User.ID
+
+		if !streams.acquire(user) {
+
+			l.Warning.Printf("[PROXY] Stream to upstream %v refused, user [ %v ] has too many streams open\n", name, getPortalSession(s).User.Username)
+
+			writeJSONError(w, http.StatusTooManyRequests, errCodeTooManyStreams, "too many streams open")
+
+			return
+
+		}
+
+		defer streams.release(user)
+
+	}
+
+	r.Header.Del("Cookie")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	setForwardedHeaders(r)
+
+	p, ok := cleanProxyPath(rest)
+
+	if !ok {
+
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid path")
+
+		return
+
+	}
+
+	r.URL.Path = p
+	r.URL.RawPath = ""
+
+	u.proxy.ServeHTTP(w, r)
+
+}
+
+// setForwardedHeaders tells the upstream which host and scheme the browser used;
+// behind a load balancer terminating tls, they are only known from the headers set
+// by the load balancer, which are kept if proxy.trustforwardedheaders is set
+func setForwardedHeaders(r *http.Request) {
+
+	trusted := cfg.Proxy.TrustForwardedHeaders
+
+	if !trusted || r.Header.Get("X-Forwarded-Host") == "" {
+
+		r.Header.Set("X-Forwarded-Host", r.Host)
+
+	}
+
+	if trusted && r.Header.Get("X-Forwarded-Proto") != "" {
+
+		return
+
+	}
+
+	r.Header.Set("X-Forwarded-Proto", "http")
+
+	if r.TLS != nil {
+
+		r.Header.Set("X-Forwarded-Proto", "https")
+
+	}
+
+}
+
+// splitProxyPath splits the escaped path of a proxied request into the service name
+// and the rest of the path, eg /api/workflow/runs/1 into workflow and /runs/1
+func splitProxyPath(p string) (name, rest string) {
+
+	p = strings.TrimPrefix(p, proxyPathPrefix)
+
+	if i := strings.Index(p, "/"); i >= 0 {
+
+		return strings.ToLower(p[:i]), p[i:]
+
+	}
+
+	return strings.ToLower(p), "/"
+
+}
+
+// cleanProxyPath unescapes the path of a proxied request and resolves its dot
+// segments, so that the request cannot reach the upstream outside of its base url
+// (eg /api/workflow/../admin); false is returned if the path is invalid
+func cleanProxyPath(rest string) (string, bool) {
+
+	p, e := url.PathUnescape(rest)
+
+	if e != nil {
+
+		return "", false
+
+	}
+
+	cleaned := path.Clean(p)
+
+	if !strings.HasPrefix(cleaned, "/") || strings.Contains(cleaned+"/", "/../") {
+
+		return "", false
+
+	}
+
+	// the trailing slash may matter to the upstream
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+
+		cleaned += "/"
+
+	}
+
+	return cleaned, true
+
+}
+
+// sameOrigin tells whether a request which may change state comes from the portal
+// itself; as the proxy authenticates the requests with the session cookie, requests
+// sent by other sites must not reach the upstreams. Browsers send the Origin header
+// with such requests; requests without it are let through.
+func sameOrigin(r *http.Request) bool {
+
+	switch r.Method {
+
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+
+		// websocket connections are not restricted to the origin by browsers
+		if !isUpgrade(r) {
+
+			return true
+
+		}
+
+	}
+
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+
+		return true
+
+	}
+
+	o, e := url.Parse(origin)
+
+	return e == nil && strings.EqualFold(o.Host, r.Host)
+
+}
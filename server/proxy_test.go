@@ -0,0 +1,339 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upstreamRequest is what a test upstream received
+type upstreamRequest struct {
+	path          string
+	rawQuery      string
+	authorization string
+	cookie        string
+	proto         string
+}
+
+// setupProxy proxies /api/workflow to a local upstream serving under /workflow-api
+// and creates an authenticated session with an access token; the requests received
+// by the upstream and the cookie of the session are returned
+func setupProxy(t *testing.T) (chan upstreamRequest, *http.Cookie) {
+
+	t.Helper()
+
+	received := make(chan upstreamRequest, 1)
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		received <- upstreamRequest{
+			path:          r.URL.Path,
+			rawQuery:      r.URL.RawQuery,
+			authorization: r.Header.Get("Authorization"),
+			cookie:        r.Header.Get("Cookie"),
+			proto:         r.Header.Get("X-Forwarded-Proto"),
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: "upstream", Value: "1"})
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		w.Write([]byte("upstream response"))
+
+	}))
+
+	t.Cleanup(up.Close)
+
+	cfg.Session.IdleTimeout = time.Hour
+	cfg.Session.MaxLifetime = 12 * time.Hour
+
+	store = newTestServerStore(newMemoryBackend())
+	index = newLocalSessionIndex("")
+	streams = newStreamLimiter(0)
+
+	var e error
+
+	upstreams, e = newUpstreams(proxyConfig{
+		Upstreams: map[string]upstreamConfig{
+			"workflow": {
+				URL:               up.URL + "/workflow-api",
+				ConnectTimeout:    time.Second,
+				ReadTimeout:       5 * time.Second,
+				StreamIdleTimeout: time.Minute,
+			},
+		},
+	}, tlsConfig{MinVersion: "1.2"})
+
+	if e != nil {
+
+		t.Fatalf("newUpstreams: %v", e)
+
+	}
+
+	t.Cleanup(func() { upstreams = nil })
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	s, _ := store.Get(r, sessionName)
+
+	setPortalSession(s, PortalSession{
+		Authenticated: true,
+		Created:       time.Now().Unix(),
+		LastSeen:      time.Now().Unix(),
+		TokenExpiry:   time.Now().Add(time.Hour).Unix(),
+		Tokens:        sessionTokens{AccessToken: "access-token"},
+	})
+
+	if e := s.Save(r, w); e != nil {
+
+		t.Fatalf("saving the session: %v", e)
+
+	}
+
+	return received, w.Result().Cookies()[0]
+
+}
+
+// proxy serves a request through the portal with the session cookie and another
+// cookie of the portal's domain
+func proxy(method, target string, cookie *http.Cookie, header http.Header) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, target, nil)
+
+	for k, v := range header {
+
+		r.Header[k] = v
+
+	}
+
+	r.AddCookie(cookie)
+	r.AddCookie(&http.Cookie{Name: "other", Value: "portal-cookie"})
+
+	w := httptest.NewRecorder()
+
+	FileServerMiddleware().ServeHTTP(w, r)
+
+	return w
+
+}
+
+func TestProxyRequest(t *testing.T) {
+
+	received, cookie := setupProxy(t)
+
+	w := proxy(http.MethodGet, "/api/workflow/runs/1?state=running", cookie, nil)
+
+	if w.Code != http.StatusOK {
+
+		t.Fatalf("status = %v, body %q", w.Code, w.Body.String())
+
+	}
+
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "upstream response" {
+
+		t.Fatalf("body = %q, want the response of the upstream", body)
+
+	}
+
+	got := <-received
+
+	if got.authorization != "Bearer access-token" {
+
+		t.Errorf("upstream got Authorization %q, want the access token of the session", got.authorization)
+
+	}
+
+	if got.cookie != "" {
+
+		t.Errorf("upstream got the cookies %q of the browser", got.cookie)
+
+	}
+
+	if got.path != "/workflow-api/runs/1" || got.rawQuery != "state=running" {
+
+		t.Errorf("upstream got %v?%v, want /workflow-api/runs/1?state=running", got.path, got.rawQuery)
+
+	}
+
+	for _, c := range w.Result().Cookies() {
+
+		if c.Name == "upstream" {
+
+			t.Errorf("the cookie %v set by the upstream reached the browser", c)
+
+		}
+
+	}
+
+	for k := range w.Header() {
+
+		if strings.HasPrefix(k, "Access-Control-") {
+
+			t.Errorf("the cors header %v of the upstream reached the browser", k)
+
+		}
+
+	}
+
+}
+
+func TestProxyForwardedProto(t *testing.T) {
+
+	received, cookie := setupProxy(t)
+
+	defer func(c proxyConfig) { cfg.Proxy = c }(cfg.Proxy)
+
+	header := http.Header{"X-Forwarded-Proto": {"https"}}
+
+	for _, tc := range []struct {
+		trusted bool
+		want    string
+	}{
+		{false, "http"},
+		{true, "https"},
+	} {
+
+		cfg.Proxy.TrustForwardedHeaders = tc.trusted
+
+		proxy(http.MethodGet, "/api/workflow/runs", cookie, header)
+
+		if got := <-received; got.proto != tc.want {
+
+			t.Errorf("with trustforwardedheaders %v, the upstream got X-Forwarded-Proto %q, want %q", tc.trusted, got.proto, tc.want)
+
+		}
+
+	}
+
+}
+
+func TestProxyPathRewriting(t *testing.T) {
+
+	received, cookie := setupProxy(t)
+
+	for _, tc := range []struct {
+		target string
+		path   string
+	}{
+		{"/api/workflow", "/workflow-api/"},
+		{"/api/Workflow/runs/", "/workflow-api/runs/"},
+		{"/api/workflow/a%20b", "/workflow-api/a b"},
+		{"/api/workflow/runs/./1", "/workflow-api/runs/1"},
+		{"/api/workflow/../admin", "/workflow-api/admin"},
+		{"/api/workflow/%2e%2e/admin", "/workflow-api/admin"},
+		{"/api/workflow/runs/%2E%2E/%2e%2e/%2e%2e/admin", "/workflow-api/admin"},
+		{"/api/workflow/runs%2f..%2f..%2fadmin", "/workflow-api/admin"},
+	} {
+
+		w := proxy(http.MethodGet, tc.target, cookie, nil)
+
+		if w.Code != http.StatusOK {
+
+			t.Errorf("%v: status = %v, body %q", tc.target, w.Code, w.Body.String())
+
+			continue
+
+		}
+
+		if got := <-received; got.path != tc.path {
+
+			t.Errorf("%v reached the upstream as %v, want %v", tc.target, got.path, tc.path)
+
+		}
+
+	}
+
+}
+
+func TestProxyUnknownService(t *testing.T) {
+
+	_, cookie := setupProxy(t)
+
+	w := proxy(http.MethodGet, "/api/unknown/runs", cookie, nil)
+
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errCodeNotFound) {
+
+		t.Fatalf("status = %v, body %q; want 404 not_found", w.Code, w.Body.String())
+
+	}
+
+}
+
+func TestProxyRequiresSession(t *testing.T) {
+
+	setupProxy(t)
+
+	w := httptest.NewRecorder()
+
+	FileServerMiddleware().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/workflow/runs", nil))
+
+	if w.Code != http.StatusUnauthorized {
+
+		t.Fatalf("status without a session = %v, want 401", w.Code)
+
+	}
+
+}
+
+func TestProxyOrigin(t *testing.T) {
+
+	received, cookie := setupProxy(t)
+
+	w := proxy(http.MethodPost, "/api/workflow/runs", cookie, http.Header{"Origin": {"https://attacker.example.org"}})
+
+	if w.Code != http.StatusForbidden {
+
+		t.Fatalf("status of a cross origin POST = %v, want 403", w.Code)
+
+	}
+
+	select {
+
+	case got := <-received:
+
+		t.Fatalf("the cross origin POST reached the upstream: %v", got)
+
+	default:
+
+	}
+
+	// httptest requests are for example.com
+	w = proxy(http.MethodPost, "/api/workflow/runs", cookie, http.Header{"Origin": {"http://example.com"}})
+
+	if w.Code != http.StatusOK {
+
+		t.Fatalf("status of a same origin POST = %v, want 200", w.Code)
+
+	}
+
+	<-received
+
+}
+
+func TestUpstreamsOmitClientCertificate(t *testing.T) {
+
+	// the keycloak client certificate is not even loaded for the upstreams
+	u, e := newUpstreams(proxyConfig{
+		Upstreams: map[string]upstreamConfig{"workflow": {URL: "https://workflow.example.org"}},
+	}, tlsConfig{MinVersion: "1.2", ClientCertificate: "missing.pem", ClientKey: "missing.key"})
+
+	if e != nil {
+
+		t.Fatalf("newUpstreams with a keycloak client certificate: %v", e)
+
+	}
+
+	transport := u["workflow"].proxy.Transport.(*policyTransport).base.(*http.Transport)
+
+	if n := len(transport.TLSClientConfig.Certificates); n != 0 {
+
+		t.Fatalf("the upstream transport presents %v client certificates", n)
+
+	}
+
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// states of a circuit breaker
+const (
+	breakerClosed   = "closed"    // requests go through
+	breakerOpen     = "open"      // requests fail fast until the cooldown is over
+	breakerHalfOpen = "half-open" // a trial request is let through after the cooldown
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops sending requests to an upstream which keeps failing: after
+// threshold consecutive failures it opens for the cooldown, then lets a single trial
+// request through, whose outcome closes or opens it again
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+
+}
+
+// allow tells whether a request may be sent to the upstream
+func (b *circuitBreaker) allow() bool {
+
+	if b.threshold <= 0 {
+
+		return true
+
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+
+	case breakerOpen:
+
+		if time.Since(b.openedAt) < b.cooldown {
+
+			return false
+
+		}
+
+		b.state = breakerHalfOpen
+
+		return true
+
+	case breakerHalfOpen:
+
+		// the trial request is still in flight
+		return false
+
+	}
+
+	return true
+
+}
+
+// record records the outcome of a request let through by allow
+func (b *circuitBreaker) record(success bool) {
+
+	if b.threshold <= 0 {
+
+		return
+
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+
+		b.state = breakerClosed
+		b.failures = 0
+
+		return
+
+	}
+
+	b.failures++
+
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+
+	}
+
+}
+
+// abort records that a request let through by allow was given up by the client, in
+// which case nothing is known about the upstream; a trial request is tried again
+func (b *circuitBreaker) abort() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+
+		b.state = breakerOpen
+
+	}
+
+}
+
+// retryIn returns how long an open breaker stays open
+func (b *circuitBreaker) retryIn() time.Duration {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+
+		return 0
+
+	}
+
+	return b.cooldown - time.Since(b.openedAt)
+
+}
+
+// BreakerStatus is the state of the circuit breaker of an upstream as reported by the
+// proxy status endpoint
+type BreakerStatus struct {
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	OpenedAt int64  `json:"opened_at,omitempty"`
+	RetryIn  int64  `json:"retry_in,omitempty"`
+}
+
+func (b *circuitBreaker) status(upstream string) (s BreakerStatus) {
+
+	b.mu.Lock()
+
+	s = BreakerStatus{
+		Upstream: upstream,
+		State:    b.state,
+		Failures: b.failures,
+	}
+
+	if b.state != breakerClosed {
+
+		s.OpenedAt = b.openedAt.Unix()
+
+	}
+
+	b.mu.Unlock()
+
+	if retryIn := b.retryIn(); retryIn > 0 {
+
+		s.RetryIn = int64(retryIn.Seconds()) + 1
+
+	}
+
+	return
+
+}
+
+// policyTransport applies the policies of an upstream to the requests sent to it:
+// requests are refused while the circuit breaker is open, idempotent requests
+// without a body are retried with an exponential backoff when the upstream cannot
+// be reached or answers 502, 503 or 504, and the outcome is recorded by the breaker.
+// Streams (websockets, server-sent events) go through the streaming transport.
+type policyTransport struct {
+	base      http.RoundTripper
+	streaming http.RoundTripper
+	breaker   *circuitBreaker
+	retries   int
+	backoff   time.Duration
+}
+
+func (t *policyTransport) RoundTrip(r *http.Request) (resp *http.Response, returnErr error) {
+
+	if !t.breaker.allow() {
+
+		returnErr = errCircuitOpen
+
+		return
+
+	}
+
+	base := t.base
+
+	if isStreaming(r) {
+
+		base = t.streaming
+
+	}
+
+	attempts := 1
+
+	if isRetryable(r) {
+
+		attempts += t.retries
+
+	}
+
+	for i := 0; i < attempts; i++ {
+
+		if i > 0 {
+
+			select {
+
+			case <-time.After(t.backoff << uint(i-1)):
+
+			case <-r.Context().Done():
+
+				returnErr = r.Context().Err()
+
+				t.breaker.abort()
+
+				return
+
+			}
+
+		}
+
+		resp, returnErr = base.RoundTrip(r)
+
+		if !isUpstreamFailure(resp, returnErr) {
+
+			break
+
+		}
+
+		// the request was cancelled by the browser, not failed by the upstream
+		if r.Context().Err() != nil {
+
+			t.breaker.abort()
+
+			return
+
+		}
+
+		if i < attempts-1 && resp != nil {
+
+			resp.Body.Close()
+
+		}
+
+	}
+
+	t.breaker.record(!isUpstreamFailure(resp, returnErr))
+
+	return
+
+}
+
+// isRetryable tells whether a request can safely be sent again: its method must be
+// idempotent and it must not have a body, which cannot be replayed
+func isRetryable(r *http.Request) bool {
+
+	switch r.Method {
+
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+
+		return r.Body == nil || r.Body == http.NoBody
+
+	}
+
+	return false
+
+}
+
+// isUpstreamFailure tells whether a response (or error) shows that the upstream is
+// not working, as opposed to rejecting the request
+func isUpstreamFailure(resp *http.Response, e error) bool {
+
+	if e != nil {
+
+		return true
+
+	}
+
+	switch resp.StatusCode {
+
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+
+		return true
+
+	}
+
+	return false
+
+}
+
+// isTimeout tells whether a request failed because the upstream did not answer in time
+func isTimeout(e error) bool {
+
+	var ne net.Error
+
+	return errors.As(e, &ne) && ne.Timeout()
+
+}
+
+// proxyStatus reports the state of the circuit breakers of the upstreams; as it
+// reveals the services behind the portal, it is only open to the admin users
+func proxyStatus(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, ok := authorizeAdmin(w, r); !ok {
+
+		return
+
+	}
+
+	status := []BreakerStatus{}
+
+	for name, u := range upstreams {
+
+		status = append(status, u.breaker.status(name))
+
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Upstream < status[j].Upstream })
+
+	writeJSON(w, http.StatusOK, status)
+
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	b := newCircuitBreaker(2, 50*time.Millisecond)
+
+	expect := func(step string, allowed bool, state string) {
+
+		t.Helper()
+
+		if got := b.allow(); got != allowed {
+
+			t.Fatalf("%v: allow = %v, want %v", step, got, allowed)
+
+		}
+
+		if got := b.status("upstream").State; got != state {
+
+			t.Fatalf("%v: state %v, want %v", step, got, state)
+
+		}
+
+	}
+
+	expect("new breaker", true, breakerClosed)
+
+	b.record(false)
+
+	expect("below the threshold", true, breakerClosed)
+
+	b.record(false)
+
+	expect("at the threshold", false, breakerOpen)
+
+	if retryIn := b.retryIn(); retryIn <= 0 || retryIn > 50*time.Millisecond {
+
+		t.Fatalf("retryIn of an open breaker = %v, want at most the cooldown", retryIn)
+
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	expect("after the cooldown", true, breakerHalfOpen)
+	expect("while the trial request is in flight", false, breakerHalfOpen)
+
+	b.record(false)
+
+	expect("after a failed trial request", false, breakerOpen)
+
+	time.Sleep(60 * time.Millisecond)
+
+	expect("after the second cooldown", true, breakerHalfOpen)
+
+	b.record(true)
+
+	expect("after a successful trial request", true, breakerClosed)
+
+	if failures := b.status("upstream").Failures; failures != 0 {
+
+		t.Fatalf("failures after closing = %v, want 0", failures)
+
+	}
+
+	// a success resets the count of consecutive failures
+	b.record(false)
+	b.record(true)
+	b.record(false)
+
+	expect("after failures which are not consecutive", true, breakerClosed)
+
+}
+
+func TestCircuitBreakerAbortedTrial(t *testing.T) {
+
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+
+	b.record(false)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.allow() {
+
+		t.Fatal("no trial request allowed after the cooldown")
+
+	}
+
+	b.abort()
+
+	if b.status("upstream").State != breakerOpen {
+
+		t.Fatalf("state after an aborted trial request = %v, want open", b.status("upstream").State)
+
+	}
+
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+
+	b := newCircuitBreaker(0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+
+		b.record(false)
+
+	}
+
+	if !b.allow() {
+
+		t.Fatal("a disabled breaker refused a request")
+
+	}
+
+}
+
+func TestIsRetryable(t *testing.T) {
+
+	for _, tc := range []struct {
+		method string
+		body   string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodOptions, "", true},
+		{http.MethodDelete, "", true},
+		{http.MethodPut, "", true},
+		{http.MethodPut, `{"name":"run"}`, false},
+		{http.MethodGet, "query", false},
+		{http.MethodPost, "", false},
+		{http.MethodPost, `{"name":"run"}`, false},
+		{http.MethodPatch, `{"name":"run"}`, false},
+	} {
+
+		r, _ := http.NewRequest(tc.method, "http://upstream/runs", nil)
+
+		if tc.body != "" {
+
+			r, _ = http.NewRequest(tc.method, "http://upstream/runs", strings.NewReader(tc.body))
+
+		}
+
+		if got := isRetryable(r); got != tc.want {
+
+			t.Errorf("isRetryable(%v with body %q) = %v, want %v", tc.method, tc.body, got, tc.want)
+
+		}
+
+	}
+
+}
+
+func TestProxyStatusRequiresAdmin(t *testing.T) {
+
+	_, cookie := setupProxy(t)
+
+	defer func(c sessionConfig) { cfg.Session = c }(cfg.Session)
+
+	status := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+
+		r := httptest.NewRequest(http.MethodGet, "/status/proxy", nil)
+
+		if cookie != nil {
+
+			r.AddCookie(cookie)
+
+		}
+
+		w := httptest.NewRecorder()
+
+		FileServerMiddleware().ServeHTTP(w, r)
+
+		return w
+
+	}
+
+	cfg.Session.AdminUsers = []string{"admin-id"}
+
+	if w := status(nil); w.Code != http.StatusUnauthorized {
+
+		t.Fatalf("status without a session: %v, want 401", w.Code)
+
+	}
+
+	if w := status(cookie); w.Code != http.StatusForbidden {
+
+		t.Fatalf("status with the session of a user: %v, want 403", w.Code)
+
+	}
+
+	w := status(newUserSession(t, UserInfo{ID: "admin-id", Username: "admin"}))
+
+	var breakers []BreakerStatus
+
+	if e := json.Unmarshal(w.Body.Bytes(), &breakers); w.Code != http.StatusOK || e != nil || len(breakers) != 1 || breakers[0].Upstream != "workflow" {
+
+		t.Fatalf("status with the session of an admin: %v, body %q; want the breaker of workflow", w.Code, w.Body.String())
+
+	}
+
+}
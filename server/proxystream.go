@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isStreaming tells whether a proxied request opens a long lived stream: a websocket
+// upgrade or a server-sent events subscription
+func isStreaming(r *http.Request) bool {
+
+	return isUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+}
+
+// isUpgrade tells whether a request asks for a protocol upgrade, eg to websocket
+func isUpgrade(r *http.Request) bool {
+
+	return r.Header.Get("Upgrade") != "" && strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+
+}
+
+// idleTimeoutConn closes a connection on which nothing has been read or written for
+// the timeout; every read and write extends the deadline, in both directions, so
+// that a stream is kept as long as either side is active
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+
+	return c.Conn.Read(b)
+
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+
+	return c.Conn.Write(b)
+
+}
+
+// newStreamingTransport derives from the transport of an upstream the one used for
+// streams: its connections are closed after the idle timeout and are not reused, so
+// that the deadlines do not affect regular requests
+func newStreamingTransport(t *http.Transport, idleTimeout time.Duration) *http.Transport {
+
+	st := t.Clone()
+
+	dial := t.DialContext
+
+	st.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		conn, e := dial(ctx, network, addr)
+
+		if e != nil {
+
+			return nil, e
+
+		}
+
+		return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+
+	}
+
+	st.DisableKeepAlives = true
+
+	return st
+
+}
+
+// streamLimiter caps the number of streams a user can have open through the proxy
+type streamLimiter struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+func newStreamLimiter(max int) *streamLimiter {
+
+	return &streamLimiter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+
+}
+
+// acquire reserves a stream for the user; false is returned if the user already has
+// the maximum number of streams open
+func (s *streamLimiter) acquire(user string) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 && s.counts[user] >= s.max {
+
+		return false
+
+	}
+
+	s.counts[user]++
+
+	return true
+
+}
+
+// release frees a stream reserved with acquire
+func (s *streamLimiter) release(user string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts[user]--; s.counts[user] <= 0 {
+
+		delete(s.counts, user)
+
+	}
+
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// redisBackend keeps the sessions in redis, which allows several portal instances
+// to share them; the sessions expire in redis together with the cookie
+type redisBackend struct {
+	client    *redis.Client
+	namespace string
+	prefix    string
+}
+
+// newRedisBackend connects to the configured redis server and checks that it can be
+// reached
+func newRedisBackend(c sessionConfig) (*redisBackend, error) {
+
+	b := &redisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:     c.RedisAddress,
+			Password: c.RedisPassword,
+			DB:       c.RedisDB,
+		}),
+		namespace: "session",
+		prefix:    c.RedisKeyPrefix,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if e := b.client.Ping(ctx).Err(); e != nil {
+
+		return nil, fmt.Errorf("unable to reach redis at %v - %v", c.RedisAddress, e)
+
+	}
+
+	return b, nil
+
+}
+
+// withNamespace returns a backend sharing the connection of b whose keys live in
+// another namespace, eg for the token vault
+func (b *redisBackend) withNamespace(namespace string) *redisBackend {
+
+	return &redisBackend{
+		client:    b.client,
+		namespace: namespace,
+		prefix:    b.prefix,
+	}
+
+}
+
+func (b *redisBackend) sessionKey(id string) string {
+
+	return b.prefix + b.namespace + ":" + id
+
+}
+
+func (b *redisBackend) load(id string) (string, error) {
+
+	data, e := b.client.Get(context.Background(), b.sessionKey(id)).Result()
+
+	if e == redis.Nil {
+
+		return "", errSessionNotFound
+
+	}
+
+	return data, e
+
+}
+
+func (b *redisBackend) save(id string, data string, ttl time.Duration) error {
+
+	return b.client.Set(context.Background(), b.sessionKey(id), data, ttl).Err()
+
+}
+
+func (b *redisBackend) delete(id string) error {
+
+	return b.client.Del(context.Background(), b.sessionKey(id)).Err()
+
+}
+
+func (b *redisBackend) exists(id string) (bool, error) {
+
+	n, e := b.client.Exists(context.Background(), b.sessionKey(id)).Result()
+
+	return n > 0, e
+
+}
+
+// Close closes the connections to redis, which are shared by all the namespaces
+func (b *redisBackend) Close() error {
+
+	return b.client.Close()
+
+}
+
+// touchScript sets the last activity time of a record of the index in redis itself,
+// so that a record added or removed in the meantime by another request or portal
+// instance is not overwritten
+var touchScript = redis.NewScript(`
+local data = redis.call("HGET", KEYS[1], ARGV[1])
+
+if not data then
+	return 0
+end
+
+local rec = cjson.decode(data)
+
+rec.lastseen = tonumber(ARGV[2])
+
+redis.call("HSET", KEYS[1], ARGV[1], cjson.encode(rec))
+
+return 1
+`)
+
+// redisSessionIndex keeps the session index in a redis hash next to the sessions,
+// so that it is shared by all the portal instances. The sessions expire in redis
+// while their records stay in the hash, so the records of the sessions which are
+// gone are dropped as the index is searched.
+type redisSessionIndex struct {
+	client   *redis.Client
+	key      string
+	sessions *redisBackend
+}
+
+func newRedisSessionIndex(b *redisBackend) *redisSessionIndex {
+
+	return &redisSessionIndex{
+		client:   b.client,
+		key:      b.prefix + "index",
+		sessions: b,
+	}
+
+}
+
+func (i *redisSessionIndex) Add(rec SessionRecord) error {
+
+	data, e := json.Marshal(rec)
+
+	if e != nil {
+
+		return e
+
+	}
+
+	return i.client.HSet(context.Background(), i.key, rec.ID, data).Err()
+
+}
+
+func (i *redisSessionIndex) Remove(id string) error {
+
+	return i.client.HDel(context.Background(), i.key, id).Err()
+
+}
+
+func (i *redisSessionIndex) Touch(id string, lastSeen int64) error {
+
+	return touchScript.Run(context.Background(), i.client, []string{i.key}, id, lastSeen).Err()
+
+}
+
+func (i *redisSessionIndex) Find(match func(SessionRecord) bool) (recs []SessionRecord, returnErr error) {
+
+	ctx := context.Background()
+
+	all, e := i.client.HGetAll(ctx, i.key).Result()
+
+	if e != nil || len(all) == 0 {
+
+		returnErr = e
+
+		return
+
+	}
+
+	ids := make([]string, 0, len(all))
+	exists := make([]*redis.IntCmd, 0, len(all))
+
+	_, e = i.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+
+		for id := range all {
+
+			ids = append(ids, id)
+			exists = append(exists, p.Exists(ctx, i.sessions.sessionKey(id)))
+
+		}
+
+		return nil
+
+	})
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	var gone []string
+
+	for n, id := range ids {
+
+		if exists[n].Val() == 0 {
+
+			gone = append(gone, id)
+
+			continue
+
+		}
+
+		var rec SessionRecord
+
+		if json.Unmarshal([]byte(all[id]), &rec) == nil && match(rec) {
+
+			recs = append(recs, rec)
+
+		}
+
+	}
+
+	if len(gone) == 0 {
+
+		return
+
+	}
+
+	if e = i.client.HDel(ctx, i.key, gone...).Err(); e != nil {
+
+		l.Warning.Printf("[INDEX] Error dropping the records of %v expired sessions: %v\n", len(gone), e)
+
+	}
+
+	return
+
+}
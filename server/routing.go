@@ -2,32 +2,107 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
-	"github.com/Nerzal/gocloak/v7"
 	"github.com/coreos/go-oidc"
-	"github.com/go-openapi/runtime"
-	"github.com/go-openapi/runtime/middleware"
+	"github.com/gorilla/sessions"
 	l "gitlab.com/cyclops-utilities/logging"
+	"golang.org/x/oauth2"
 )
 
-// login is called when the front end tries to log in. It currently is implemented
-// as a primitive redirect; it should probably check the login status first and act
-// accordingly
-func login(w http.ResponseWriter, r *http.Request) middleware.Responder {
+// error codes returned to the front end in json error responses
+const (
+	errCodeForbidden           = "forbidden"
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeNotAuthenticated    = "not_authenticated"
+	errCodeNotFound            = "not_found"
+	errCodeProviderUnavailable = "provider_unavailable"
+	errCodeRefreshRejected     = "refresh_token_invalid"
+	errCodeSessionError        = "session_error"
+	errCodeTokenExchangeDenied = "token_exchange_denied"
+	errCodeTooManyStreams      = "too_many_streams"
+	errCodeUpstreamCircuitOpen = "upstream_circuit_open"
+	errCodeUpstreamTimeout     = "upstream_timeout"
+	errCodeUpstreamUnavailable = "upstream_unavailable"
+	errCodeUserInfoFailed      = "user_info_failed"
+)
+
+type LogoutInfo struct {
+	Authenticated bool   `json:"authenticated"`
+	EndSessionURL string `json:"end_session_url,omitempty"`
+}
+
+type ErrorInfo struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// login is called when the front end tries to log in. It generates a random state
+// for this login attempt, binds it to the session and redirects the browser to the
+// openid provider; the state is checked again when the callback arrives.
+func login(w http.ResponseWriter, r *http.Request) error {
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil {
+
+		l.Warning.Printf("[ROUTING] Error getting session: %v\n", e)
+
+	}
+
+	state, e := randomString(32)
+
+	if e != nil {
+
+		return newLoginError(loginErrInternal, fmt.Errorf("unable to generate login state: %w", e))
+
+	}
+
+	pl := PendingLogin{ReturnTo: sanitizeReturnTo(r.URL.Query().Get("return_to"))}
+
+	if pl.Nonce, e = randomString(32); e != nil {
+
+		return newLoginError(loginErrInternal, fmt.Errorf("unable to generate login nonce: %w", e))
+
+	}
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(pl.Nonce)}
+
+	if cfg.Keycloak.PKCE != pkceOff {
+
+		if pl.CodeVerifier, e = randomString(32); e != nil {
+
+			return newLoginError(loginErrInternal, fmt.Errorf("unable to generate pkce code verifier: %w", e))
+
+		}
+
+		opts = append(opts, oauth2.SetAuthURLParam("code_challenge", pkceChallenge(pl.CodeVerifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	}
+
+	addPendingLogin(s, state, pl)
+
+	if e = s.Save(r, w); e != nil {
 
-	// implements the login with a redirection
-	return middleware.ResponderFunc(
+		return newLoginError(loginErrSessionFailed, fmt.Errorf("error saving session information: %w", e))
 
-		func(w http.ResponseWriter, pr runtime.Producer) {
+	}
 
-			l.Info.Printf("[ROUTING] Returning redirect...\n")
+	l.Info.Printf("[ROUTING] Returning redirect...\n")
 
-			http.Redirect(w, r, Oauth2Config.AuthCodeURL(state), http.StatusFound)
+	http.Redirect(w, r, Oauth2Config.AuthCodeURL(state, opts...), http.StatusFound)
 
-		})
+	return nil
 
 }
 
@@ -35,34 +110,69 @@ func login(w http.ResponseWriter, r *http.Request) middleware.Responder {
 // information from the openid provider and determines whether the login was
 // successful. Note that as per standard OpenID flows, we expect the callbadk to
 // contain a state and a code.
-func callback(w http.ResponseWriter, r *http.Request) (string, error) {
+func callback(w http.ResponseWriter, r *http.Request) error {
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil {
+
+		l.Warning.Printf("[ROUTING] Error getting session: %v\n", e)
+
+	}
+
+	// the state is consumed before anything else is done so that it cannot be
+	// replayed, even if the rest of the login fails
+	pl, e := consumePendingLogin(s, r.URL.Query().Get("state"))
 
-	if r.URL.Query().Get("state") != state {
+	if e2 := s.Save(r, w); e2 != nil {
 
-		l.Info.Printf("[ROUTING] State did not match\n")
+		l.Warning.Printf("[ROUTING] Error saving session information: %v\n", e2)
 
-		return "", fmt.Errorf("state did not match")
+	}
+
+	if errors.Is(e, errStateExpired) {
+
+		return newLoginError(loginErrStateExpired, e)
 
 	}
 
-	myClient := &http.Client{}
+	if e != nil {
 
-	parentContext := context.Background()
+		return newLoginError(loginErrStateInvalid, e)
 
-	ctx := oidc.ClientContext(parentContext, myClient)
+	}
+
+	// the provider reports failed or cancelled logins with an error parameter
+	if kcErr := r.URL.Query().Get("error"); kcErr != "" {
+
+		return newLoginError(loginErrProvider, fmt.Errorf("provider returned %v: %v", kcErr, r.URL.Query().Get("error_description")))
+
+	}
+
+	var opts []oauth2.AuthCodeOption
+
+	if pl.CodeVerifier != "" {
+
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", pl.CodeVerifier))
+
+	} else if cfg.Keycloak.PKCE == pkceRequired {
+
+		return newLoginError(loginErrPKCEMissing, errors.New("no pkce code verifier found for the login"))
+
+	}
+
+	ctx := keycloakContext(context.Background())
 
 	// Exchange converts an authorization code into an access token.
 	// Under the hood, the oauth2 client POST a request to do so
 	// at tokenURL, then redirects...
 	authCode := r.URL.Query().Get("code")
 
-	oauth2Token, e := Oauth2Config.Exchange(ctx, authCode)
+	oauth2Token, e := Oauth2Config.Exchange(ctx, authCode, opts...)
 
 	if e != nil {
 
-		l.Info.Printf("[ROUTING] Failed to exchange token: %v\n", e)
-
-		return "", fmt.Errorf("failed to exchange token")
+		return newLoginError(loginErrExchangeFailed, fmt.Errorf("failed to exchange token: %w", e))
 
 	}
 
@@ -70,40 +180,155 @@ func callback(w http.ResponseWriter, r *http.Request) (string, error) {
 	// l.Debug.Printf("[ROUTING] Access token : %v\n", oauth2Token.AccessToken)
 	// l.Debug.Printf("[ROUTING] Refresh token : %v\n", oauth2Token.RefreshToken)
 
-	u, _ := getUserInfo(oauth2Token.AccessToken)
+	idToken, e := verifyIDToken(ctx, oauth2Token, pl.Nonce)
+
+	if e != nil {
+
+		return newLoginError(loginErrIDTokenInvalid, fmt.Errorf("failed to verify id token: %w", e))
+
+	}
+
+	var u UserInfo
+
+	if cfg.Keycloak.UseIDTokenClaims {
+
+		var claims map[string]interface{}
 
-	e = updateSession(w, r, u, oauth2Token.AccessToken, oauth2Token.RefreshToken)
+		if e = idToken.Claims(&claims); e != nil {
+
+			return newLoginError(loginErrIDTokenInvalid, fmt.Errorf("failed to parse id token claims: %w", e))
+
+		}
+
+		u = getUserInfoFromClaims(claims, oauth2Token.AccessToken)
+
+	} else {
+
+		if u, e = getUserInfo(oauth2Token.AccessToken); e != nil {
+
+			return newLoginError(userInfoErrorCode(e), e)
+
+		}
+
+	}
+
+	if e = updateSession(w, r, u, oauth2Token, true); e != nil {
+
+		if errors.Is(e, errSessionLimit) {
+
+			return newLoginError(loginErrSessionLimit, e)
+
+		}
+
+		if errors.Is(e, errSessionTooLarge) {
+
+			return newLoginError(loginErrSessionTooLarge, e)
+
+		}
+
+		return newLoginError(loginErrSessionFailed, e)
+
+	}
+
+	returnTo := pl.ReturnTo
+
+	if returnTo == "" {
+
+		returnTo = "/"
+
+	}
+
+	l.Info.Printf("[ROUTING] User [ %v ] logged in, session %v\n", u.Username, s.ID)
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
+
+	return nil
+
+}
+
+// verifyIDToken checks the ID token returned with the oauth2 token: its signature,
+// issuer, audience and expiry are checked by the verifier, then the nonce is matched
+// against the one sent with the login and the access token against the at_hash claim
+func verifyIDToken(ctx context.Context, t *oauth2.Token, nonce string) (*oidc.IDToken, error) {
+
+	rawIDToken, ok := t.Extra("id_token").(string)
+
+	if !ok || rawIDToken == "" {
+
+		return nil, errors.New("no id token in token response")
+
+	}
+
+	idToken, e := IDTokenVerifier.Verify(ctx, rawIDToken)
 
 	if e != nil {
 
-		l.Info.Printf("[ROUTING] Error updating session: %v\n", e)
+		return nil, e
 
-		return "", nil
+	}
+
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+
+		return nil, errNonceInvalid
 
 	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	if idToken.AccessTokenHash != "" {
+
+		if e = idToken.VerifyAccessToken(t.AccessToken); e != nil {
 
-	// never called...
-	return "", nil
+			return nil, e
+
+		}
+
+	}
+
+	return idToken, nil
 
 }
 
-func logout(w http.ResponseWriter, r *http.Request) {
+// sanitizeReturnTo checks that the page to return to after the login is a relative
+// path on this server, so that the login cannot be abused as an open redirect; an
+// empty string is returned if it is not
+func sanitizeReturnTo(returnTo string) string {
 
-	keycloakService := getKeycloakService(cfg.Keycloak)
+	if returnTo == "" || !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") ||
+		strings.ContainsAny(returnTo, "\\\x00\r\n\t") {
 
-	client := gocloak.NewClient(keycloakService)
+		return ""
 
-	ctx := context.Background()
+	}
 
-	// adminToken, e := client.LoginClient(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
+	u, e := url.Parse(returnTo)
 
-	// if e != nil {
+	if e != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
 
-	// 	l.Warning.Printf("[ROUTING] Error logging in to keycloak: %v\n", e)
+		return ""
 
-	// }
+	}
+
+	// going back to the auth endpoints after the login makes no sense
+	if strings.HasPrefix(u.Path, "/auth/") {
+
+		return ""
+
+	}
+
+	return u.String()
+
+}
+
+// pkceChallenge derives the S256 code challenge from a PKCE code verifier as
+// defined in RFC 7636
+func pkceChallenge(verifier string) string {
+
+	h := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(h[:])
+
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
 
 	s, e := store.Get(r, sessionName)
 
@@ -113,21 +338,115 @@ func logout(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if s.IsNew {
+	// the id token is needed as a hint for the provider and is gone once the
+	// session has been ended
+	endSessionURL := getEndSessionURL(getSessionTokens(s).IDToken)
+
+	if !s.IsNew {
 
-		l.Info.Printf("[ROUTING] New session created with ID %v\n", s.ID)
+		endSession(w, r, s)
 
-		e := s.Save(r, w)
+	} else if _, e := r.Cookie(sessionName); e == nil {
 
-		if e != nil {
+		// nothing is saved for an anonymous visitor, the cookie of a session which
+		// is gone is just removed
+		s.Options.MaxAge = -1
 
-			l.Warning.Printf("[ROUTING] Error saving session information: %v\n", e)
+		if e = s.Save(r, w); e != nil {
+
+			l.Warning.Printf("[ROUTING] Error removing the session cookie: %v\n", e)
 
 		}
 
 	}
 
-	e = client.Logout(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm, getStringValueFromSession(s, "refToken"))
+	switch {
+
+	case wantsJSON(r):
+
+		writeJSON(w, http.StatusOK, LogoutInfo{EndSessionURL: endSessionURL})
+
+	case cfg.Keycloak.RPLogout && endSessionURL != "":
+
+		http.Redirect(w, r, endSessionURL, http.StatusFound)
+
+	}
+
+}
+
+// getEndSessionURL returns the url of the provider's end session endpoint to which
+// the browser is sent to end the sso session (rp initiated logout); an empty string
+// is returned if the provider does not support it
+func getEndSessionURL(idToken string) string {
+
+	if EndSessionEndpoint == "" {
+
+		return ""
+
+	}
+
+	u, e := url.Parse(EndSessionEndpoint)
+
+	if e != nil {
+
+		l.Warning.Printf("[ROUTING] Invalid end session endpoint %v: %v\n", EndSessionEndpoint, e)
+
+		return ""
+
+	}
+
+	q := u.Query()
+
+	q.Set("client_id", cfg.Keycloak.ClientID)
+
+	if idToken != "" {
+
+		q.Set("id_token_hint", idToken)
+
+	}
+
+	if cfg.Keycloak.PostLogoutRedirectURL != "" {
+
+		q.Set("post_logout_redirect_uri", cfg.Keycloak.PostLogoutRedirectURL)
+
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String()
+
+}
+
+// wantsJSON tells whether the request comes from a script expecting a json response
+// rather than from a browser navigation
+func wantsJSON(r *http.Request) bool {
+
+	return r.URL.Query().Get("mode") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		r.Header.Get("X-Requested-With") == "XMLHttpRequest"
+
+}
+
+// endSession logs the user of the session out of keycloak and clears the session
+func endSession(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+
+	client := newKeycloakClient()
+
+	ctx := context.Background()
+
+	// adminToken, e := client.LoginClient(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm)
+
+	// if e != nil {
+
+	// 	l.Warning.Printf("[ROUTING] Error logging in to keycloak: %v\n", e)
+
+	// }
+
+	ps := getPortalSession(s)
+
+	tokens := ps.getTokens(s.ID)
+
+	e := client.Logout(ctx, cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm, tokens.RefreshToken)
 
 	if e != nil {
 
@@ -135,20 +454,21 @@ func logout(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	s.Values["authenticated"] = false
-	s.Values["token"] = ""
-	s.Values["refToken"] = ""
-	s.Values["firstname"] = ""
-	s.Values["lastname"] = ""
-	s.Values["email"] = ""
-	s.Values["username"] = ""
-	s.Values["emailverified"] = ""
-	s.Values["role"] = ""
-	s.Values["keycloakid"] = ""
-	s.Values["permissions"] = ""
+	exchanges.forget(tokens.AccessToken)
+
+	ps.clearTokens(s.ID)
+
+	// only the logins in flight survive the end of the session
+	setPortalSession(s, PortalSession{PendingLogins: ps.PendingLogins})
 
 	s.Options.MaxAge = -1
 
+	if e = index.Remove(s.ID); e != nil {
+
+		l.Warning.Printf("[ROUTING] Error removing session %v from the index: %v\n", s.ID, e)
+
+	}
+
 	e = s.Save(r, w)
 
 	if e != nil {
@@ -159,40 +479,149 @@ func logout(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func FileServerMiddleware() http.Handler {
+// refresh is called by the front end when a service rejected its token; it obtains
+// new tokens using the refresh token of the session, derives the role and projects
+// of the user again and returns the updated session information
+func refresh(w http.ResponseWriter, r *http.Request) {
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 
-		session, _ := store.Get(r, sessionName)
+		w.Header().Set("Allow", http.MethodPost)
 
-		if session.IsNew {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "the refresh endpoint only accepts POST requests")
 
-			l.Info.Printf("[ROUTING] New session\n")
+		return
 
-		}
+	}
 
-		l.Info.Printf("[ROUTING] Session id = %v\n", session.ID)
+	s, e := store.Get(r, sessionName)
 
-		session.Values["test"] = false
+	if e != nil {
 
-		e := session.Save(r, w)
+		l.Warning.Printf("[ROUTING] Error getting session: %v\n", e)
 
-		if e != nil {
+	}
 
-			l.Warning.Printf("[ROUTING] Error saving session information: %v\n", e)
+	if !keepSessionAlive(w, r, s) {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session is not authenticated or has expired")
+
+		return
+
+	}
+
+	t, e := refreshTokens(s)
+
+	if e != nil {
+
+		if isRefreshRejected(e) {
+
+			l.Info.Printf("[ROUTING] Refresh token of session %v rejected, logging out: %v\n", s.ID, e)
+
+			endSession(w, r, s)
+
+			writeJSONError(w, http.StatusUnauthorized, errCodeRefreshRejected, "the refresh token is expired or has been revoked")
+
+			return
 
 		}
 
+		l.Warning.Printf("[ROUTING] Unable to refresh the tokens of session %v: %v\n", s.ID, e)
+
+		writeJSONError(w, http.StatusBadGateway, errCodeProviderUnavailable, "the identity provider could not be reached")
+
+		return
+
+	}
+
+	u, e := getUserInfo(t.AccessToken)
+
+	if e != nil {
+
+		l.Warning.Printf("[ROUTING] Unable to get the user info for session %v: %v\n", s.ID, e)
+
+		writeJSONError(w, http.StatusBadGateway, errCodeUserInfoFailed, "the user information could not be obtained")
+
+		return
+
+	}
+
+	if e = updateSession(w, r, u, t, false); e != nil {
+
+		l.Warning.Printf("[ROUTING] Error updating session: %v\n", e)
+
+		writeJSONError(w, http.StatusInternalServerError, errCodeSessionError, "the session could not be updated")
+
+		return
+
+	}
+
+	writeJSON(w, http.StatusOK, newSessionInfo(s))
+
+}
+
+// writeJSON writes v as a json response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	j, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+
+}
+
+// writeJSONError writes a json error response with a machine readable code and a
+// human readable message
+func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
+
+	writeJSON(w, status, ErrorInfo{Error: code, Message: message})
+
+}
+
+func FileServerMiddleware() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// the session is only touched by the auth endpoints and the html pages of
+		// the front end; static assets are served without going to the store
 		l.Info.Printf("[ROUTING] Serving endpoint request %v\n", r.URL)
 
 		switch {
 
+		case r.URL.Path == "/status/ready":
+
+			readiness(w, r)
+
+		case r.URL.Path == "/status/proxy":
+
+			proxyStatus(w, r)
+
+		case strings.HasPrefix(r.URL.Path, proxyPathPrefix):
+
+			proxyRequest(w, r)
+
+		case r.URL.Path == tokenEndpointPath:
+
+			tokenEndpoint(w, r)
+
+		case strings.HasPrefix(r.URL.Path, "/auth/admin/sessions"):
+
+			adminSessions(w, r)
+
 		case strings.HasPrefix(r.URL.Path, "/auth/login"):
 
 			l.Info.Printf("[ROUTING] Calling login function\n")
 
-			http.Redirect(w, r, Oauth2Config.AuthCodeURL(state), http.StatusFound)
-			// login(w, r)
+			if e := login(w, r); e != nil {
+
+				loginFailed(w, r, e)
+
+			}
+
+		case strings.HasPrefix(r.URL.Path, "/auth/backchannel-logout"):
+
+			backchannelLogout(w, r)
 
 		case strings.HasPrefix(r.URL.Path, "/auth/logout"):
 
@@ -200,7 +629,15 @@ func FileServerMiddleware() http.Handler {
 
 		case strings.HasPrefix(r.URL.Path, "/auth/callback"):
 
-			callback(w, r)
+			if e := callback(w, r); e != nil {
+
+				loginFailed(w, r, e)
+
+			}
+
+		case strings.HasPrefix(r.URL.Path, "/auth/refresh"):
+
+			refresh(w, r)
 
 		case strings.HasPrefix(r.URL.Path, "/auth/session-info"):
 
@@ -213,10 +650,18 @@ func FileServerMiddleware() http.Handler {
 			strings.HasPrefix(r.URL.Path, "/workflow"),
 			strings.HasPrefix(r.URL.Path, "/error"):
 
+			touchSession(w, r)
+
 			http.ServeFile(w, r, cfg.General.FrontEndDir+"/index.html")
 
 		default:
 
+			if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+
+				touchSession(w, r)
+
+			}
+
 			http.FileServer(http.Dir(cfg.General.FrontEndDir)).ServeHTTP(w, r)
 
 		}
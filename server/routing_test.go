@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+func TestMain(m *testing.M) {
+
+	// the handlers log every request
+	l.InitLogger("", "error", false)
+
+	// registered by createSessionStore in the portal
+	gob.Register(PortalSession{})
+	gob.Register(map[string]PendingLogin{})
+
+	os.Exit(m.Run())
+
+}
+
+// countingStore counts the calls made to a store
+type countingStore struct {
+	portalStore
+	gets  int64
+	saves int64
+}
+
+func (c *countingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+
+	atomic.AddInt64(&c.gets, 1)
+
+	return sessions.GetRegistry(r).Get(c, name)
+
+}
+
+// New binds the sessions to the counting store, so that their saves are counted
+func (c *countingStore) New(r *http.Request, name string) (*sessions.Session, error) {
+
+	s, e := c.portalStore.New(r, name)
+
+	bound := sessions.NewSession(c, name)
+	bound.ID = s.ID
+	bound.IsNew = s.IsNew
+	bound.Options = s.Options
+	bound.Values = s.Values
+
+	return bound, e
+
+}
+
+func (c *countingStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+
+	atomic.AddInt64(&c.saves, 1)
+
+	return c.portalStore.Save(r, w, s)
+
+}
+
+// setupFrontEnd serves a front end with an index page and a static asset, with an
+// authenticated session in a counting memory store; the cookie of the session is
+// returned
+func setupFrontEnd(tb testing.TB) (*countingStore, *http.Cookie) {
+
+	tb.Helper()
+
+	dir := tb.TempDir()
+
+	os.MkdirAll(filepath.Join(dir, "static", "js"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "static", "js", "main.js"), make([]byte, 4096), 0644)
+
+	cfg.General.FrontEndDir = dir
+	cfg.Session.IdleTimeout = time.Hour
+	cfg.Session.MaxLifetime = 12 * time.Hour
+
+	cs := &countingStore{portalStore: newTestServerStore(newMemoryBackend())}
+
+	store = cs
+	index = newLocalSessionIndex("")
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	s, _ := store.Get(r, sessionName)
+
+	setPortalSession(s, PortalSession{
+		Authenticated: true,
+		Created:       time.Now().Unix(),
+		LastSeen:      time.Now().Unix(),
+	})
+
+	if e := s.Save(r, w); e != nil {
+
+		tb.Fatalf("saving the session: %v", e)
+
+	}
+
+	atomic.StoreInt64(&cs.gets, 0)
+	atomic.StoreInt64(&cs.saves, 0)
+
+	return cs, w.Result().Cookies()[0]
+
+}
+
+func TestStaticAssetSkipsSessionStore(t *testing.T) {
+
+	cs, cookie := setupFrontEnd(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/static/js/main.js", nil)
+	r.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+
+	FileServerMiddleware().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+
+		t.Fatalf("status of the static asset = %v", w.Code)
+
+	}
+
+	if cs.gets != 0 || cs.saves != 0 {
+
+		t.Fatalf("serving a static asset made %v gets and %v saves, want none", cs.gets, cs.saves)
+
+	}
+
+}
+
+// BenchmarkFileServerMiddlewareStaticAsset compares serving a static asset, which
+// does not go to the session store, with serving it after reading and saving the
+// session as was done for every request before
+func BenchmarkFileServerMiddlewareStaticAsset(b *testing.B) {
+
+	cs, cookie := setupFrontEnd(b)
+
+	f := FileServerMiddleware()
+
+	saveOnEveryRequest := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if s, e := store.Get(r, sessionName); e == nil {
+
+			s.Save(r, w)
+
+		}
+
+		f.ServeHTTP(w, r)
+
+	})
+
+	for _, bc := range []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"static asset", f},
+		{"save on every request", saveOnEveryRequest},
+	} {
+
+		b.Run(bc.name, func(b *testing.B) {
+
+			atomic.StoreInt64(&cs.gets, 0)
+			atomic.StoreInt64(&cs.saves, 0)
+
+			for i := 0; i < b.N; i++ {
+
+				r := httptest.NewRequest(http.MethodGet, "/static/js/main.js", nil)
+				r.AddCookie(cookie)
+
+				bc.handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			}
+
+			b.ReportMetric(float64(atomic.LoadInt64(&cs.gets))/float64(b.N), "gets/op")
+			b.ReportMetric(float64(atomic.LoadInt64(&cs.saves))/float64(b.N), "saves/op")
+
+		})
+
+	}
+
+}
+
+func TestAnonymousRequestsSaveNoSession(t *testing.T) {
+
+	cs, _ := setupFrontEnd(t)
+
+	for _, target := range []string{"/", "/auth/session-info", "/auth/logout?mode=json"} {
+
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+
+		FileServerMiddleware().ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+
+			t.Fatalf("GET %v: status %v, body %q", target, w.Code, w.Body.String())
+
+		}
+
+		if len(w.Result().Cookies()) != 0 {
+
+			t.Errorf("GET %v set the cookies %v for an anonymous visitor", target, w.Result().Cookies())
+
+		}
+
+	}
+
+	if saves := atomic.LoadInt64(&cs.saves); saves != 0 {
+
+		t.Fatalf("anonymous requests saved %v sessions", saves)
+
+	}
+
+}
+
+func TestSanitizeReturnTo(t *testing.T) {
+
+	for _, tc := range []struct {
+		returnTo string
+		want     string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/project/abc", "/project/abc"},
+		{"/workflow/run?id=1&view=log#step-2", "/workflow/run?id=1&view=log#step-2"},
+		{"/a%20b", "/a%20b"},
+		{"project/abc", ""},
+		{"//evil.example.org", ""},
+		{"///evil.example.org", ""},
+		{"/\\evil.example.org", ""},
+		{"\\\\evil.example.org", ""},
+		{"https://evil.example.org", ""},
+		{"javascript:alert(1)", ""},
+		{"/%2F%2Fevil.example.org", "/%2F%2Fevil.example.org"},
+		{"/%5Cevil.example.org", "/%5Cevil.example.org"},
+		{"/\t/evil.example.org", ""},
+		{"/\r\nLocation: https://evil.example.org", ""},
+		{"/\x00evil", ""},
+		{"/\x01evil", ""},
+		{"/\x7fevil", ""},
+		{"/auth/login", ""},
+	} {
+
+		if got := sanitizeReturnTo(tc.returnTo); got != tc.want {
+
+			t.Errorf("sanitizeReturnTo(%q) = %q, want %q", tc.returnTo, got, tc.want)
+
+		}
+
+	}
+
+}
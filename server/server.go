@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// draining is set when the portal is stopping; the readiness probe then reports the
+// portal as not ready, so that the load balancer stops sending it new requests
+var draining int32
+
+// ReadyInfo is returned by the readiness probe
+type ReadyInfo struct {
+	Ready bool `json:"ready"`
+}
+
+// readiness serves the readiness probe, /status/ready; it answers 503 while the
+// portal is draining its connections before stopping
+func readiness(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if atomic.LoadInt32(&draining) != 0 {
+
+		writeJSON(w, http.StatusServiceUnavailable, ReadyInfo{Ready: false})
+
+		return
+
+	}
+
+	writeJSON(w, http.StatusOK, ReadyInfo{Ready: true})
+
+}
+
+// newServer creates the http server of the portal with the configured timeouts; the
+// write timeout is off by default, as it would cut the streams of the proxy
+func newServer(c generalConfig, h http.Handler) *http.Server {
+
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(c.ServerPort),
+		Handler:           h,
+		IdleTimeout:       c.IdleTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+	}
+
+}
+
+// serve runs the server until it fails or the process receives SIGTERM or SIGINT, in
+// which case the portal is stopped gracefully: the readiness probe reports not ready
+// for the drain period while requests are still served, then the server stops
+// accepting connections and waits up to the shutdown timeout for the requests in
+// flight, after which the remaining connections are closed. Websockets are not
+// waited for; they are closed when the process exits.
+func serve(server *http.Server, c generalConfig) (returnErr error) {
+
+	errs := make(chan error, 1)
+
+	go func() {
+
+		if c.HttpsEnabled {
+
+			errs <- server.ListenAndServeTLS(c.CertificateFile, c.CertificateKey)
+
+		} else {
+
+			errs <- server.ListenAndServe()
+
+		}
+
+	}()
+
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	defer signal.Stop(signals)
+
+	select {
+
+	case returnErr = <-errs:
+
+		return
+
+	case sig := <-signals:
+
+		l.Info.Printf("[SERVER] Received %v, draining for %v before stopping\n", sig, c.DrainPeriod)
+
+	}
+
+	atomic.StoreInt32(&draining, 1)
+
+	// a second signal skips the rest of the drain period
+	select {
+
+	case <-signals:
+
+	case <-time.After(c.DrainPeriod):
+
+	}
+
+	l.Info.Printf("[SERVER] Stopping, waiting up to %v for the requests in flight\n", c.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	if e := server.Shutdown(ctx); e != nil {
+
+		l.Warning.Printf("[SERVER] Requests still in flight after %v, closing their connections: %v\n", c.ShutdownTimeout, e)
+
+		server.Close()
+
+	}
+
+	return
+
+}
+
+// stopPortal releases the resources of the portal once the server has stopped: the
+// session sweeper is stopped and the connections of the session store are closed;
+// the logging library writes the log without buffering, so nothing is left to flush
+func stopPortal() {
+
+	if sweeper != nil {
+
+		sweeper.Stop()
+
+	}
+
+	if e := store.Close(); e != nil {
+
+		l.Warning.Printf("[SERVER] Error closing the session store: %v\n", e)
+
+	}
+
+	l.Info.Printf("[SERVER] %v version %v stopped\n", serviceName, version)
+
+}
@@ -1,25 +1,63 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 	l "gitlab.com/cyclops-utilities/logging"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	indexTouchInterval = time.Minute      // the last activity in the session index is updated at most this often
+	loginStateTTL      = 10 * time.Minute // time allowed to complete a login at the provider
+	maxPendingLogins   = 10               // logins that can be in flight for one session (eg several tabs)
+	tokenRefreshMargin = 30 * time.Second // tokens expiring within this margin are refreshed
+)
+
+var (
+	errStateUnknown    = errors.New("state unknown or already used")
+	errStateExpired    = errors.New("state expired")
+	errNonceInvalid    = errors.New("nonce does not match")
+	errNoRefToken      = errors.New("no refresh token in session")
+	errSessionLimit    = errors.New("too many sessions")
+	errSessionTooLarge = errors.New("session too large")
+)
+
+// PendingLogin holds the information of a login which has been started from this
+// session but for which the callback has not been received yet. Pending logins are
+// kept in the session keyed by their state.
+type PendingLogin struct {
+	CodeVerifier string
+	Expires      int64
+	Nonce        string
+	ReturnTo     string
+}
+
 type SessionInfo struct {
-	Authenticated bool     `json:"authenticated"`
-	ID            string   `json:"id"`
-	Token         string   `json:"token"`
-	User          UserInfo `json:"auth"`
+	Authenticated    bool     `json:"authenticated"`
+	ID               string   `json:"id"`
+	SessionExpiresIn int64    `json:"session_expires_in"`
+	Token            string   `json:"token"`
+	TokenExpiry      int64    `json:"token_expiry"`
+	User             UserInfo `json:"auth"`
 }
 
-// updateSession is called from the callback after a successful authentication; it
-// populates the session info with the user data.
-func updateSession(w http.ResponseWriter, r *http.Request, u UserInfo, t string, refT string) (returnErr error) {
+// updateSession is called from the callback after a successful authentication, with
+// login set, and after a refresh of the tokens; it populates the session info with
+// the user data and the tokens.
+func updateSession(w http.ResponseWriter, r *http.Request, u UserInfo, t *oauth2.Token, login bool) (returnErr error) {
 
 	session, e := store.Get(r, sessionName)
 
@@ -37,24 +75,94 @@ func updateSession(w http.ResponseWriter, r *http.Request, u UserInfo, t string,
 
 	}
 
-	session.Values["authenticated"] = true
-	session.Values["token"] = t
-	session.Values["refToken"] = refT
-	session.Values["firstname"] = u.Firstname
-	session.Values["lastname"] = u.Lastname
-	session.Values["email"] = u.EmailAddress
-	session.Values["username"] = u.Username
-	session.Values["emailverified"] = u.EmailVerified
-	session.Values["keycloakid"] = u.ID
-	session.Values["role"] = u.Role
-	session.Values["permissions"] = u.Permissions
-	session.Values["ddi-projects"] = u.DDIProjects
+	// keycloak reports its session id as session_state, logout tokens refer to it as sid
+	sid, _ := t.Extra("session_state").(string)
+
+	ps := getPortalSession(session)
+
+	// the absolute lifetime of the session starts with the login, updates of an
+	// authenticated session (eg a refresh) do not extend it
+	now := time.Now().Unix()
+
+	if login || !ps.Authenticated || ps.User.ID != u.ID {
+
+		// the session cookie is the only credential of the session, so a login gets
+		// a new session ID and whatever was kept for the previous one is dropped
+		if session.ID != "" {
+
+			if e = destroySession(session.ID); e != nil {
+
+				l.Warning.Printf("[SESSION] Error destroying session %v before the login: %v\n", session.ID, e)
+
+			}
+
+			session.ID = ""
+
+		}
+
+		if e = enforceSessionLimit(u, sid); e != nil {
+
+			returnErr = fmt.Errorf("[SESSION] Session limit of user [ %v ] reached - %w", u.Username, e)
+
+			return
+
+		}
+
+		ps.Created = now
+
+	}
+
+	// the tokens are stored in the vault by session ID, which is assigned on the
+	// first save
+	if vault != nil && session.ID == "" {
+
+		if e = session.Save(r, w); e != nil {
+
+			returnErr = fmt.Errorf("[SESSION] Error saving session information - %w\n", e)
+
+			return
+
+		}
+
+	}
+
+	if e = ps.setTokens(session.ID, t); e != nil {
+
+		returnErr = fmt.Errorf("[SESSION] Error storing the tokens of the session - %v\n", e)
+
+		return
+
+	}
+
+	ps.Authenticated = true
+	ps.LastSeen = now
+	ps.User = u
+
+	setPortalSession(session, ps)
 
 	e = session.Save(r, w)
 
 	if e != nil {
 
-		returnErr = fmt.Errorf("[SESSION] Error saving session information - %v\n", e)
+		returnErr = fmt.Errorf("[SESSION] Error saving session information - %w\n", e)
+
+		return
+
+	}
+
+	e = index.Add(SessionRecord{
+		ID:              session.ID,
+		KeycloakID:      u.ID,
+		KeycloakSession: sid,
+		Username:        u.Username,
+		Role:            u.Role,
+		Created:         ps.Created,
+		LastSeen:        now,
+	})
+
+	if e != nil {
+
+		l.Warning.Printf("[SESSION] Error adding session %v to the index: %v\n", session.ID, e)
 
 	}
 
@@ -62,15 +170,180 @@ func updateSession(w http.ResponseWriter, r *http.Request, u UserInfo, t string,
 
 }
 
-// getStringValueFromSession obtains a string value from a session with the given
-// key
-func getStringValueFromSession(s *sessions.Session, k string) (str string) {
+// enforceSessionLimit applies the per user session limit to a new login of the user,
+// whose session is not in the index yet. If the user already has the maximum number of
+// sessions, depending on the policy either errSessionLimit is returned or the oldest
+// sessions are revoked to make room for the new one; sessions of the keycloak
+// session of the login are only destroyed, as logging them out of keycloak would end
+// the new login as well.
+func enforceSessionLimit(u UserInfo, sid string) error {
+
+	if cfg.Session.MaxPerUser <= 0 {
+
+		return nil
+
+	}
+
+	recs, e := findSessions(func(rec SessionRecord) bool {
 
-	stemp := s.Values[k]
+		return rec.KeycloakID == u.ID
 
-	if stemp != nil {
+	})
+
+	if e != nil {
 
-		str = stemp.(string)
+		return e
+
+	}
+
+	excess := len(recs) - cfg.Session.MaxPerUser + 1
+
+	if excess <= 0 {
+
+		return nil
+
+	}
+
+	if cfg.Session.LimitPolicy == limitPolicyReject {
+
+		l.Warning.Printf("[SESSION] Login of user [ %v ] rejected, the user already has %v session(s)\n", u.Username, len(recs))
+
+		return errSessionLimit
+
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Created < recs[j].Created })
+
+	for _, rec := range recs[:excess] {
+
+		if sid != "" && rec.KeycloakSession == sid {
+
+			e = destroySession(rec.ID)
+
+		} else {
+
+			e = revokeSession(rec.ID)
+
+		}
+
+		if e != nil {
+
+			return e
+
+		}
+
+		l.Warning.Printf("[SESSION] Session %v of user [ %v ] evicted, the user reached the limit of %v session(s)\n", rec.ID, u.Username, cfg.Session.MaxPerUser)
+
+	}
+
+	return nil
+
+}
+
+// destroySession removes a session from the store and the index by its ID, outside
+// of any request for that session; the next request with the session's cookie gets
+// a new, unauthenticated session
+func destroySession(id string) error {
+
+	if e := store.Delete(id); e != nil {
+
+		return e
+
+	}
+
+	if vault != nil {
+
+		if e := vault.remove(id); e != nil {
+
+			return e
+
+		}
+
+	}
+
+	return index.Remove(id)
+
+}
+
+// revokeSession ends a session by its ID, outside of any request for that session:
+// the user is logged out of keycloak with the refresh token stored for the session
+// and the session is destroyed
+func revokeSession(id string) error {
+
+	tokens := getStoredTokens(id)
+
+	exchanges.forget(tokens.AccessToken)
+
+	if refT := tokens.RefreshToken; refT != "" {
+
+		e := newKeycloakClient().Logout(context.Background(), cfg.Keycloak.ClientID, cfg.Keycloak.ClientSecret, cfg.Keycloak.Realm, refT)
+
+		if e != nil {
+
+			l.Warning.Printf("[SESSION] Error logging out the user of session %v from keycloak: %v\n", id, e)
+
+		}
+
+	}
+
+	return destroySession(id)
+
+}
+
+// getStoredTokens returns the tokens of a session by its ID, outside of any request
+// for that session; empty tokens are returned if they cannot be found (eg with the
+// cookie backend, where only the browser has them)
+func getStoredTokens(id string) sessionTokens {
+
+	s := sessions.NewSession(store, sessionName)
+	s.ID = id
+
+	if values, e := store.Load(id); e == nil {
+
+		s.Values = values
+
+	}
+
+	return getSessionTokens(s)
+
+}
+
+// findSessions returns the index records of the sessions for which match returns
+// true; records of sessions which no longer exist in the store (eg expired ones)
+// are dropped from the index on the way
+func findSessions(match func(SessionRecord) bool) (recs []SessionRecord, returnErr error) {
+
+	all, e := index.Find(match)
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	for _, rec := range all {
+
+		exists, e := store.Exists(rec.ID)
+
+		if e != nil {
+
+			returnErr = e
+
+			return
+
+		}
+
+		if !exists {
+
+			index.Remove(rec.ID)
+
+			continue
+
+		}
+
+		recs = append(recs, rec)
 
 	}
 
@@ -78,13 +351,150 @@ func getStringValueFromSession(s *sessions.Session, k string) (str string) {
 
 }
 
-func getStringArrayValueFromSession(s *sessions.Session, k string) (strArray []string) {
+// setSessionTokens stores the tokens obtained from the openid provider for a
+// session, see PortalSession.setTokens
+func setSessionTokens(s *sessions.Session, t *oauth2.Token) error {
+
+	ps := getPortalSession(s)
+
+	e := ps.setTokens(s.ID, t)
+
+	setPortalSession(s, ps)
+
+	return e
+
+}
+
+// getSessionTokens returns the tokens of a session, from the token vault if it is
+// enabled; empty tokens are returned if the session has none
+func getSessionTokens(s *sessions.Session) sessionTokens {
+
+	ps := getPortalSession(s)
+
+	return ps.getTokens(s.ID)
+
+}
+
+// tokenRefresher makes sure that a refresh token is only used once. The front end
+// sends requests in parallel, which all find the access token about to expire;
+// concurrent refreshes with the same refresh token share a single request to the
+// provider, and requests still holding the refresh token shortly after it was used
+// get the result of that refresh. Otherwise, the provider could reject the reused
+// refresh token (when it revokes refresh tokens after one use) and the user would be
+// logged out.
+type tokenRefresher struct {
+	group singleflight.Group
+
+	mu     sync.Mutex
+	recent map[string]refreshResult // keyed by the hash of the refresh token used
+}
+
+type refreshResult struct {
+	token *oauth2.Token
+	at    time.Time
+}
+
+var refresher tokenRefresher
+
+// refresh obtains new tokens with the refresh token, unless it has been used
+// recently, in which case the tokens obtained then are returned
+func (r *tokenRefresher) refresh(refT string) (*oauth2.Token, error) {
+
+	key := tokenHash(refT)
+
+	if t, found := r.recentResult(key); found {
+
+		return t, nil
+
+	}
+
+	v, e, _ := r.group.Do(key, func() (interface{}, error) {
+
+		ctx := keycloakContext(context.Background())
+
+		// an expired token forces the token source to go to the provider
+		t, e := Oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refT, Expiry: time.Unix(1, 0)}).Token()
+
+		if e != nil {
+
+			return nil, e
+
+		}
+
+		r.remember(key, t)
+
+		return t, nil
+
+	})
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	return v.(*oauth2.Token), nil
+
+}
+
+// recentResult returns the tokens obtained with a refresh token within the refresh
+// margin
+func (r *tokenRefresher) recentResult(key string) (*oauth2.Token, bool) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res, found := r.recent[key]
+
+	return res.token, found && time.Since(res.at) < tokenRefreshMargin
+
+}
+
+// remember keeps the result of a refresh for the refresh margin
+func (r *tokenRefresher) remember(key string, t *oauth2.Token) {
 
-	satemp := s.Values[k]
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if satemp != nil {
+	if r.recent == nil {
 
-		strArray = satemp.([]string)
+		r.recent = make(map[string]refreshResult)
+
+	}
+
+	for k, res := range r.recent {
+
+		if time.Since(res.at) >= tokenRefreshMargin {
+
+			delete(r.recent, k)
+
+		}
+
+	}
+
+	r.recent[key] = refreshResult{token: t, at: time.Now()}
+
+}
+
+// refreshTokens obtains new tokens from the openid provider using the refresh token
+// stored in the session, see tokenRefresher; the session itself is not modified
+func refreshTokens(s *sessions.Session) (t *oauth2.Token, returnErr error) {
+
+	refT := getSessionTokens(s).RefreshToken
+
+	if refT == "" {
+
+		returnErr = errNoRefToken
+
+		return
+
+	}
+
+	t, e := refresher.refresh(refT)
+
+	if e != nil {
+
+		returnErr = fmt.Errorf("unable to refresh token - %w", e)
 
 	}
 
@@ -92,6 +502,135 @@ func getStringArrayValueFromSession(s *sessions.Session, k string) (strArray []s
 
 }
 
+// reloadSession replaces the values of a session with the ones in the store, which
+// a concurrent request for the session may have updated since it was read; sessions
+// the store does not hold (cookie backend) are left as they are
+func reloadSession(s *sessions.Session) {
+
+	if s.ID == "" {
+
+		return
+
+	}
+
+	if values, e := store.Load(s.ID); e == nil {
+
+		s.Values = values
+
+	}
+
+}
+
+// isRefreshRejected tells whether a refresh failed because the provider rejected
+// the refresh token (expired, revoked or missing), rather than because it could not
+// be reached; other error responses, eg a 503 from a proxy in front of the provider,
+// do not count as a rejection
+func isRefreshRejected(e error) bool {
+
+	if errors.Is(e, errNoRefToken) {
+
+		return true
+
+	}
+
+	var re *oauth2.RetrieveError
+
+	if !errors.As(e, &re) {
+
+		return false
+
+	}
+
+	if re.Response != nil {
+
+		switch re.Response.StatusCode {
+
+		case http.StatusBadRequest, http.StatusUnauthorized:
+
+			return true
+
+		}
+
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	return json.Unmarshal(re.Body, &body) == nil && body.Error == "invalid_grant"
+
+}
+
+// ensureFreshToken refreshes the tokens of an authenticated session when the access
+// token is about to expire. If the provider rejects the refresh, the user is logged
+// out and false is returned; if the provider cannot be reached, the session is left
+// as it is
+func ensureFreshToken(w http.ResponseWriter, r *http.Request, s *sessions.Session) bool {
+
+	ps := getPortalSession(s)
+
+	if !ps.Authenticated || time.Until(ps.tokenExpiry()) > tokenRefreshMargin {
+
+		return true
+
+	}
+
+	// a concurrent request may have refreshed the tokens in the meantime
+	reloadSession(s)
+
+	if ps = getPortalSession(s); !ps.Authenticated {
+
+		return false
+
+	}
+
+	if time.Until(ps.tokenExpiry()) > tokenRefreshMargin {
+
+		return true
+
+	}
+
+	t, e := refreshTokens(s)
+
+	if e == nil {
+
+		// the session is saved on top of what concurrent requests saved meanwhile
+		reloadSession(s)
+
+		e = setSessionTokens(s, t)
+
+	}
+
+	if e == nil {
+
+		l.Debug.Printf("[SESSION] Refreshed the tokens of session %v\n", s.ID)
+
+		if e = s.Save(r, w); e != nil {
+
+			l.Warning.Printf("[SESSION] Error saving session information: %v\n", e)
+
+		}
+
+		return true
+
+	}
+
+	if isRefreshRejected(e) {
+
+		l.Info.Printf("[SESSION] Token refresh rejected for session %v, logging out: %v\n", s.ID, e)
+
+		endSession(w, r, s)
+
+		return false
+
+	}
+
+	l.Warning.Printf("[SESSION] Unable to refresh the tokens of session %v: %v\n", s.ID, e)
+
+	return true
+
+}
+
 // sessionInfo is called when there is a request to obtain the information for the
 // session
 func sessionInfo(w http.ResponseWriter, r *http.Request) {
@@ -104,86 +643,345 @@ func sessionInfo(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if s.IsNew {
+	// anonymous visitors get their (empty) session info without a session being
+	// saved for them, see touchSession
+	if keepSessionAlive(w, r, s) {
 
-		l.Info.Printf("[SESSION] New session created with ID: %v\n", s.ID)
+		ensureFreshToken(w, r, s)
 
-		e := s.Save(r, w)
+	}
 
-		if e != nil {
+	writeJSON(w, http.StatusOK, newSessionInfo(s))
 
-			l.Warning.Printf("[SESSION] Error saving session information: %v\n", e)
+}
+
+// newSessionInfo creates the session information returned to the front end from
+// the portal session
+func newSessionInfo(s *sessions.Session) (i SessionInfo) {
+
+	ps := getPortalSession(s)
+
+	i = SessionInfo{
+		ID:            s.ID, // session ID
+		Authenticated: ps.Authenticated,
+		User:          ps.User,
+	}
+
+	// with the token vault the tokens never leave the portal
+	if vault == nil {
+
+		i.Token = ps.Tokens.AccessToken
+
+	}
+
+	if i.Authenticated {
+
+		if exp := ps.tokenExpiry(); !exp.IsZero() {
+
+			i.TokenExpiry = exp.Unix()
 
 		}
 
+		i.SessionExpiresIn = int64(time.Until(ps.expiry()).Seconds())
+
 	}
 
-	u := UserInfo{
-		EmailAddress:  getStringValueFromSession(s, "email"),
-		EmailVerified: s.Values["emailverified"] == "true",
-		Firstname:     getStringValueFromSession(s, "firstname"),
-		ID:            getStringValueFromSession(s, "keycloakid"),
-		Lastname:      getStringValueFromSession(s, "lastname"),
-		Role:          getStringValueFromSession(s, "role"),
-		Username:      getStringValueFromSession(s, "username"),
-		DDIProjects:   getStringArrayValueFromSession(s, "ddi-projects"),
+	return
+
+}
+
+// touchSession is called when the user loads a page of the front end; it records
+// the activity of an authenticated session. No session is created for anonymous
+// visitors, they get one when they log in.
+func touchSession(w http.ResponseWriter, r *http.Request) {
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil || s.IsNew {
+
+		return
+
 	}
 
-	if permissions, exists := s.Values["permissions"]; exists {
+	keepSessionAlive(w, r, s)
+
+}
+
+// keepSessionAlive records activity on an authenticated session, extending its idle
+// timeout; the session is only saved when the activity recorded is older than the
+// index touch interval. A session which is idle for too long or has reached its
+// maximum lifetime is ended instead and false is returned; false is also returned
+// for unauthenticated sessions.
+func keepSessionAlive(w http.ResponseWriter, r *http.Request, s *sessions.Session) bool {
+
+	ps := getPortalSession(s)
 
-		u.Permissions = permissions.(map[string]interface{})
+	if !ps.Authenticated {
+
+		return false
 
 	}
 
-	i := SessionInfo{
-		ID:            s.ID, // session ID
-		Authenticated: isAuthenticated(s),
-		Token:         getStringValueFromSession(s, "token"),
-		User:          u,
+	now := time.Now()
+
+	if now.After(ps.expiry()) {
+
+		l.Info.Printf("[SESSION] Session %v of user [ %v ] expired, logging out\n", s.ID, ps.User.Username)
+
+		endSession(w, r, s)
+
+		return false
+
 	}
 
-	j, _ := json.Marshal(i)
+	changed := false
+
+	if ps.Created == 0 {
+
+		ps.Created = now.Unix()
+
+		changed = true
+
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(j)
+	// the last activity is written at most once per interval, which is precise
+	// enough for the idle timeout and spares a save on every request
+	if now.Unix()-ps.LastSeen >= int64(indexTouchInterval.Seconds()) {
+
+		if e := index.Touch(s.ID, now.Unix()); e != nil {
+
+			l.Warning.Printf("[SESSION] Error updating session %v in the index: %v\n", s.ID, e)
+
+		}
+
+		ps.LastSeen = now.Unix()
+
+		changed = true
+
+	}
+
+	if !changed {
+
+		return true
+
+	}
+
+	setPortalSession(s, ps)
+
+	if e := s.Save(r, w); e != nil {
+
+		l.Warning.Printf("[SESSION] Error saving session information: %v\n", e)
+
+	}
+
+	return true
 
 }
 
 // isAuthenticated checks is a session is authenticated or not
 func isAuthenticated(s *sessions.Session) bool {
 
-	auth := s.Values["authenticated"]
+	return getPortalSession(s).Authenticated
 
-	if auth == nil {
+}
 
-		return false
+// randomString returns a url safe string encoding n bytes of cryptographically
+// secure random data
+func randomString(n int) (string, error) {
+
+	b := make([]byte, n)
+
+	if _, e := rand.Read(b); e != nil {
+
+		return "", e
+
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+
+}
+
+// getPendingLogins returns the logins in flight for the session, dropping those
+// which have expired
+func getPendingLogins(s *sessions.Session) map[string]PendingLogin {
+
+	pending := make(map[string]PendingLogin)
+
+	now := time.Now().Unix()
+
+	for state, pl := range getPortalSession(s).PendingLogins {
+
+		if pl.Expires > now {
+
+			pending[state] = pl
+
+		}
+
+	}
+
+	return pending
+
+}
+
+// addPendingLogin stores a new login with the given state in the session; if
+// there are too many logins in flight, the one closest to expiry is dropped
+func addPendingLogin(s *sessions.Session, state string, pl PendingLogin) {
+
+	pending := getPendingLogins(s)
+
+	for len(pending) >= maxPendingLogins {
+
+		oldest := ""
+
+		for k, v := range pending {
+
+			if oldest == "" || v.Expires < pending[oldest].Expires {
+
+				oldest = k
+
+			}
+
+		}
+
+		delete(pending, oldest)
+
+	}
+
+	pl.Expires = time.Now().Add(loginStateTTL).Unix()
+
+	pending[state] = pl
+
+	ps := getPortalSession(s)
+
+	ps.PendingLogins = pending
+
+	setPortalSession(s, ps)
+
+}
+
+// consumePendingLogin removes the login with the given state from the session and
+// returns it; a state can only be consumed once, any subsequent attempt to use it
+// fails as unknown
+func consumePendingLogin(s *sessions.Session, state string) (pl PendingLogin, returnErr error) {
+
+	ps := getPortalSession(s)
+
+	pl, exists := ps.PendingLogins[state]
+
+	if state == "" || !exists {
+
+		returnErr = errStateUnknown
+
+		return
 
 	}
 
-	return auth.(bool)
+	delete(ps.PendingLogins, state)
+
+	setPortalSession(s, ps)
+
+	if pl.Expires <= time.Now().Unix() {
+
+		returnErr = errStateExpired
+
+	}
+
+	return
 
 }
 
-// createSessionStore creates a session store which is stored in an directory defined
-// at compile time. There was an issue with the default behaviour; if no session directory
-// is specified, then /tmp is assumed, However, for minimal containers, /tmp is not always
-// present.- hence we went with this approach
-func createSessionStore() {
+// createSessionStore creates the session store for the configured backend. For the
+// filesystem backend the sessions are stored in a directory defined at compile time.
+// There was an issue with the default behaviour; if no session directory is specified,
+// then /tmp is assumed, However, for minimal containers, /tmp is not always present.-
+// hence we went with this approach
+func createSessionStore() (returnErr error) {
+
+	// values stored in the session other than basic types need to be known by gob
+	gob.Register(PortalSession{})
+	gob.Register(map[string]PendingLogin{})
+
+	// types of the keycloak attributes held in the permissions of the user
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+
+	options := &sessions.Options{
+		Domain:   cfg.Session.CookieDomain,
+		HttpOnly: cfg.Session.CookieHTTPOnly,
+		MaxAge:   int(cfg.Session.CookieMaxAge.Seconds()),
+		Path:     cfg.Session.CookiePath,
+		SameSite: sameSiteModes[cfg.Session.CookieSameSite],
+		Secure:   cfg.Session.CookieSecure,
+	}
+
+	if options.Secure && !cfg.General.HttpsEnabled {
+
+		l.Warning.Printf("[SESSION] The session cookie is secure but TLS is disabled, browsers only send it over https (eg through a TLS terminating proxy)...\n")
+
+	}
+
+	if options.SameSite == http.SameSiteStrictMode {
+
+		l.Warning.Printf("[SESSION] The session cookie is SameSite strict, browsers do not send it on the redirect back from keycloak and logins fail unless keycloak is on the same site...\n")
+
+	}
+
+	if cfg.Session.BlockKey == "" {
+
+		l.Warning.Printf("[SESSION] No session block key configured, sessions are signed but not encrypted...\n")
+
+	}
+
+	store, index, returnErr = newPortalStore(cfg.Session, options, sessionKeyPairs(cfg.Session)...)
+
+	if returnErr != nil || !cfg.Session.TokenVault {
+
+		return
+
+	}
+
+	vault, returnErr = newTokenVault([]byte(cfg.Session.TokenVaultKey), store, cfg.Session.MaxLifetime)
+
+	return
+
+}
+
+// sessionKeyPairs returns the hash and block key pairs of the session codecs: the
+// current pair first, which is used to encode the sessions, then the previous pairs,
+// which are only tried when decoding. Sessions encoded with a previous pair remain
+// valid and are re-encoded with the current pair when they are next saved, so that
+// the keys can be rotated without logging the users out.
+func sessionKeyPairs(c sessionConfig) (keyPairs [][]byte) {
+
+	keyPairs = append(keyPairs, []byte(c.HashKey), blockKey(c.BlockKey))
+
+	for i, k := range c.PreviousHashKeys {
+
+		b := ""
+
+		if i < len(c.PreviousBlockKeys) {
+
+			b = c.PreviousBlockKeys[i]
+
+		}
+
+		keyPairs = append(keyPairs, []byte(k), blockKey(b))
+
+	}
+
+	return
+
+}
 
-	os.Mkdir(sessionDir, 0744)
+// blockKey returns nil for an empty block key, which disables the encryption
+func blockKey(k string) []byte {
 
-	key := []byte(cfg.General.SessionKey)
+	if k == "" {
 
-	store = sessions.NewFilesystemStore(sessionDir, key)
+		return nil
 
-	store.Options = &sessions.Options{
-		Domain: cfg.General.SessionDomain,
-		Path:   "/",
-		MaxAge: 3600, // 1h
-		Secure: true,
 	}
 
-	store.MaxLength(1048576) // 1MB
+	return []byte(k)
 
 }
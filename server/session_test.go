@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+func TestKeepSessionAliveThrottlesSaves(t *testing.T) {
+
+	cs, cookie := setupFrontEnd(t)
+
+	keepAlive := func() {
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+
+		s, _ := store.Get(r, sessionName)
+
+		if !keepSessionAlive(httptest.NewRecorder(), r, s) {
+
+			t.Fatal("keepSessionAlive ended an active session")
+
+		}
+
+	}
+
+	for i := 0; i < 3; i++ {
+
+		keepAlive()
+
+	}
+
+	if saves := atomic.LoadInt64(&cs.saves); saves != 0 {
+
+		t.Fatalf("keepSessionAlive saved a session seen just now %v times", saves)
+
+	}
+
+	// the session was last seen longer ago than the interval
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+
+	s, _ := store.Get(r, sessionName)
+
+	ps := getPortalSession(s)
+	ps.LastSeen = time.Now().Add(-2 * indexTouchInterval).Unix()
+	setPortalSession(s, ps)
+
+	s.Save(r, httptest.NewRecorder())
+
+	atomic.StoreInt64(&cs.saves, 0)
+
+	keepAlive()
+	keepAlive()
+
+	if saves := atomic.LoadInt64(&cs.saves); saves != 1 {
+
+		t.Fatalf("keepSessionAlive saved %v times after the interval, want once", saves)
+
+	}
+
+}
+
+// loginInSession completes a login of the user in the session of the cookie and
+// returns the session the browser then holds
+func loginInSession(t *testing.T, cookie *http.Cookie, u UserInfo) (*sessions.Session, error) {
+
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback", nil)
+	r.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+
+	token := &oauth2.Token{AccessToken: "access-" + u.ID, Expiry: time.Now().Add(time.Hour)}
+
+	if e := updateSession(w, r, u, token, true); e != nil {
+
+		return nil, e
+
+	}
+
+	s, _ := store.Get(requestWithCookies(w), sessionName)
+
+	return s, nil
+
+}
+
+func TestLoginInAuthenticatedSession(t *testing.T) {
+
+	_, cookie := setupFrontEnd(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+
+	old, _ := store.Get(r, sessionName)
+
+	// the session of another user, about to reach its max lifetime
+	ps := getPortalSession(old)
+	ps.Created = time.Now().Add(-11 * time.Hour).Unix()
+	ps.User = UserInfo{ID: "alice-id", Username: "alice"}
+	setPortalSession(old, ps)
+
+	old.Save(r, httptest.NewRecorder())
+
+	index.Add(SessionRecord{ID: old.ID, KeycloakID: "alice-id", Created: ps.Created})
+
+	s, e := loginInSession(t, cookie, UserInfo{ID: "bob-id", Username: "bob"})
+
+	if e != nil {
+
+		t.Fatalf("login: %v", e)
+
+	}
+
+	if s.IsNew || s.ID == old.ID {
+
+		t.Fatalf("the login kept session ID %v (new %v), want a new ID", s.ID, s.IsNew)
+
+	}
+
+	if exists, _ := store.Exists(old.ID); exists {
+
+		t.Fatal("the session of the previous login still exists")
+
+	}
+
+	if created := getPortalSession(s).Created; time.Since(time.Unix(created, 0)) > time.Minute {
+
+		t.Fatalf("the login kept the creation time %v of the previous login", time.Unix(created, 0))
+
+	}
+
+	recs, _ := findSessions(func(SessionRecord) bool { return true })
+
+	if len(recs) != 1 || recs[0].ID != s.ID || recs[0].KeycloakID != "bob-id" || recs[0].Created != getPortalSession(s).Created {
+
+		t.Fatalf("index records after the login = %+v, want only the new session", recs)
+
+	}
+
+}
+
+func TestLoginInAuthenticatedSessionEnforcesLimit(t *testing.T) {
+
+	_, cookie := setupFrontEnd(t)
+
+	defer func(c sessionConfig) { cfg.Session = c }(cfg.Session)
+
+	cfg.Session.MaxPerUser = 1
+	cfg.Session.LimitPolicy = limitPolicyReject
+
+	// bob is already logged in from another browser
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	other, _ := store.New(r, sessionName)
+
+	other.Save(r, httptest.NewRecorder())
+
+	index.Add(SessionRecord{ID: other.ID, KeycloakID: "bob-id", Created: time.Now().Unix()})
+
+	if _, e := loginInSession(t, cookie, UserInfo{ID: "bob-id", Username: "bob"}); !errors.Is(e, errSessionLimit) {
+
+		t.Fatalf("login of a user at the session limit = %v, want errSessionLimit", e)
+
+	}
+
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// SessionRecord describes an authenticated portal session in the session index
+type SessionRecord struct {
+	ID              string `json:"id"`
+	KeycloakID      string `json:"keycloakid"`
+	KeycloakSession string `json:"keycloaksession"`
+	Username        string `json:"username"`
+	Role            string `json:"role"`
+	Created         int64  `json:"created"`
+	LastSeen        int64  `json:"lastseen"`
+}
+
+// sessionIndex keeps track of the authenticated sessions, so that sessions can be
+// found by the keycloak user or keycloak session they belong to; the session store
+// itself can only look sessions up by their ID. Records may outlive the sessions
+// they describe, see findSessions.
+type sessionIndex interface {
+	// Add adds or replaces the record of a session
+	Add(rec SessionRecord) error
+
+	// Remove removes the record of a session from the index
+	Remove(id string) error
+
+	// Touch sets the last activity time of a session in the index; touching a
+	// session which is not in the index is not an error
+	Touch(id string, lastSeen int64) error
+
+	// Find returns the records of the sessions for which match returns true
+	Find(match func(SessionRecord) bool) ([]SessionRecord, error)
+}
+
+// localSessionIndex is a session index held in memory, optionally persisted as a
+// json file next to the sessions
+type localSessionIndex struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]SessionRecord
+}
+
+// newLocalSessionIndex creates a session index persisted in the given file, loading
+// the records already in it; the index is not persisted if no file is given
+func newLocalSessionIndex(path string) *localSessionIndex {
+
+	i := &localSessionIndex{
+		path:    path,
+		records: make(map[string]SessionRecord),
+	}
+
+	if path == "" {
+
+		return i
+
+	}
+
+	data, e := ioutil.ReadFile(path)
+
+	if e != nil {
+
+		if !os.IsNotExist(e) {
+
+			l.Warning.Printf("[INDEX] Error reading session index %v: %v\n", path, e)
+
+		}
+
+		return i
+
+	}
+
+	if e = json.Unmarshal(data, &i.records); e != nil {
+
+		l.Warning.Printf("[INDEX] Error parsing session index %v, starting with an empty index: %v\n", path, e)
+
+		i.records = make(map[string]SessionRecord)
+
+	}
+
+	return i
+
+}
+
+func (i *localSessionIndex) Add(rec SessionRecord) error {
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.records[rec.ID] = rec
+
+	return i.save()
+
+}
+
+func (i *localSessionIndex) Remove(id string) error {
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, exists := i.records[id]; !exists {
+
+		return nil
+
+	}
+
+	delete(i.records, id)
+
+	return i.save()
+
+}
+
+func (i *localSessionIndex) Touch(id string, lastSeen int64) error {
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	rec, exists := i.records[id]
+
+	if !exists {
+
+		return nil
+
+	}
+
+	rec.LastSeen = lastSeen
+
+	i.records[id] = rec
+
+	return i.save()
+
+}
+
+func (i *localSessionIndex) Find(match func(SessionRecord) bool) (recs []SessionRecord, returnErr error) {
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, rec := range i.records {
+
+		if match(rec) {
+
+			recs = append(recs, rec)
+
+		}
+
+	}
+
+	return
+
+}
+
+// save writes the index to its file; the file is replaced atomically so that a
+// crash cannot leave a truncated index behind. Must be called with the lock held.
+func (i *localSessionIndex) save() error {
+
+	if i.path == "" {
+
+		return nil
+
+	}
+
+	data, e := json.Marshal(i.records)
+
+	if e != nil {
+
+		return e
+
+	}
+
+	tmp, e := ioutil.TempFile(filepath.Dir(i.path), ".index-")
+
+	if e != nil {
+
+		return e
+
+	}
+
+	if _, e = tmp.Write(data); e != nil {
+
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return e
+
+	}
+
+	if e = tmp.Close(); e != nil {
+
+		os.Remove(tmp.Name())
+
+		return e
+
+	}
+
+	return os.Rename(tmp.Name(), i.path)
+
+}
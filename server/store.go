@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// session backends which can be selected in the configuration
+const (
+	backendCookie     = "cookie"
+	backendFilesystem = "filesystem"
+	backendMemory     = "memory"
+	backendRedis      = "redis"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// portalStore is the session store used by the portal. On top of the gorilla
+// sessions.Store interface it allows sessions to be looked up and deleted by their
+// ID outside of a request for them, which is needed to invalidate sessions (eg on
+// back-channel logout).
+type portalStore interface {
+	sessions.Store
+
+	// Delete removes the session with the given ID; deleting a session which does
+	// not exist is not an error
+	Delete(id string) error
+
+	// Exists tells whether the session with the given ID still exists
+	Exists(id string) (bool, error)
+
+	// Load returns the values of the session with the given ID, or
+	// errSessionNotFound
+	Load(id string) (map[interface{}]interface{}, error)
+
+	// Close releases the connections of the store when the portal stops
+	Close() error
+}
+
+// newSessionID creates a random session ID; it is encoded with alphanumeric
+// characters only as it is used in file names and keys
+func newSessionID() string {
+
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+
+}
+
+// filesystemStore --------------------------------------------------------------
+
+// filesystemStore keeps the sessions in files in a directory, one file per session;
+// it only works for a single portal instance or with a shared directory
+type filesystemStore struct {
+	*sessions.FilesystemStore
+	dir string
+}
+
+func newFilesystemStore(dir string, keyPairs ...[]byte) *filesystemStore {
+
+	return &filesystemStore{
+		FilesystemStore: sessions.NewFilesystemStore(dir, keyPairs...),
+		dir:             dir,
+	}
+
+}
+
+// sessionFile returns the file in which the gorilla filesystem store keeps a session
+func (s *filesystemStore) sessionFile(id string) string {
+
+	return filepath.Join(s.dir, "session_"+id)
+
+}
+
+func (s *filesystemStore) Delete(id string) error {
+
+	if e := os.Remove(s.sessionFile(id)); e != nil && !os.IsNotExist(e) {
+
+		return e
+
+	}
+
+	return nil
+
+}
+
+func (s *filesystemStore) Exists(id string) (bool, error) {
+
+	_, e := os.Stat(s.sessionFile(id))
+
+	if os.IsNotExist(e) {
+
+		return false, nil
+
+	}
+
+	return e == nil, e
+
+}
+
+func (s *filesystemStore) Load(id string) (map[interface{}]interface{}, error) {
+
+	data, e := ioutil.ReadFile(s.sessionFile(id))
+
+	if os.IsNotExist(e) {
+
+		return nil, errSessionNotFound
+
+	}
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	values := make(map[interface{}]interface{})
+
+	if e = securecookie.DecodeMulti(sessionName, string(data), &values, s.Codecs...); e != nil {
+
+		return nil, e
+
+	}
+
+	return values, nil
+
+}
+
+// Close does nothing, the session files are written as the sessions are saved
+func (s *filesystemStore) Close() error {
+
+	return nil
+
+}
+
+// cookieStore ------------------------------------------------------------------
+
+// cookieStore keeps the whole session in the cookie. As the browser holds the
+// session, it can only be invalidated by remembering its ID as revoked until it
+// would have expired anyway; the revocations are held in memory, so they are lost
+// on restart and are not shared between portal instances.
+type cookieStore struct {
+	*sessions.CookieStore
+
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// the ID of a cookie session is kept in its values, the gorilla cookie store does
+// not use session IDs
+const cookieSessionIDKey = "_id"
+
+func newCookieStore(keyPairs ...[]byte) *cookieStore {
+
+	return &cookieStore{
+		CookieStore: sessions.NewCookieStore(keyPairs...),
+		revoked:     make(map[string]time.Time),
+	}
+
+}
+
+func (s *cookieStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+
+	return sessions.GetRegistry(r).Get(s, name)
+
+}
+
+func (s *cookieStore) New(r *http.Request, name string) (*sessions.Session, error) {
+
+	session, e := s.CookieStore.New(r, name)
+
+	// the session must be bound to this store so that session.Save goes through it
+	fresh := sessions.NewSession(s, name)
+	fresh.Options = session.Options
+	fresh.IsNew = true
+
+	if e != nil || session.IsNew {
+
+		return fresh, e
+
+	}
+
+	id, _ := session.Values[cookieSessionIDKey].(string)
+
+	if exists, _ := s.Exists(id); !exists {
+
+		return fresh, errSessionNotFound
+
+	}
+
+	fresh.Values = session.Values
+	fresh.ID = id
+	fresh.IsNew = false
+
+	return fresh, nil
+
+}
+
+func (s *cookieStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+
+	// a deleted session must not be usable by a copy of its cookie either
+	if session.Options.MaxAge <= 0 {
+
+		if session.ID != "" {
+
+			s.Delete(session.ID)
+
+		}
+
+		return s.CookieStore.Save(r, w, session)
+
+	}
+
+	if session.ID == "" {
+
+		session.ID = newSessionID()
+
+	}
+
+	session.Values[cookieSessionIDKey] = session.ID
+
+	if e := s.CookieStore.Save(r, w, session); e != nil {
+
+		if isValueTooLong(e) {
+
+			return fmt.Errorf("%w - the encoded session is longer than the 4096 bytes a cookie can hold", errSessionTooLarge)
+
+		}
+
+		return e
+
+	}
+
+	return nil
+
+}
+
+// isValueTooLong tells whether securecookie refused to encode a value because it
+// exceeds the maximum length of the codec
+func isValueTooLong(e error) bool {
+
+	var se securecookie.Error
+
+	return errors.As(e, &se) && se.IsUsage() && strings.Contains(e.Error(), "too long")
+
+}
+
+func (s *cookieStore) Delete(id string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for k, until := range s.revoked {
+
+		if until.Before(now) {
+
+			delete(s.revoked, k)
+
+		}
+
+	}
+
+	s.revoked[id] = now.Add(time.Duration(s.Options.MaxAge) * time.Second)
+
+	return nil
+
+}
+
+func (s *cookieStore) Exists(id string) (bool, error) {
+
+	if id == "" {
+
+		return false, nil
+
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, revoked := s.revoked[id]
+
+	return !revoked, nil
+
+}
+
+// Load always fails, the values of a cookie session are only known to the browser
+func (s *cookieStore) Load(id string) (map[interface{}]interface{}, error) {
+
+	return nil, errSessionNotFound
+
+}
+
+// Close does nothing, the sessions are held by the browsers
+func (s *cookieStore) Close() error {
+
+	return nil
+
+}
+
+// serverStore ------------------------------------------------------------------
+
+// sessionBackend stores encoded sessions by ID for the serverStore
+type sessionBackend interface {
+	// load returns the encoded session, or errSessionNotFound
+	load(id string) (string, error)
+
+	save(id string, data string, ttl time.Duration) error
+
+	delete(id string) error
+
+	exists(id string) (bool, error)
+}
+
+// serverStore keeps the sessions on the server side in a sessionBackend, the
+// cookie only carries the session ID; like in the gorilla filesystem store, the ID
+// in the cookie and the session data are encoded with the store's codecs
+type serverStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend sessionBackend
+}
+
+func newServerStore(backend sessionBackend, keyPairs ...[]byte) *serverStore {
+
+	return &serverStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		backend: backend,
+	}
+
+}
+
+// MaxLength restricts the maximum length of the encoded sessions
+func (s *serverStore) MaxLength(l int) {
+
+	for _, c := range s.Codecs {
+
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+
+			codec.MaxLength(l)
+
+		}
+
+	}
+
+}
+
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+
+	return sessions.GetRegistry(r).Get(s, name)
+
+}
+
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, e := r.Cookie(name)
+
+	if e != nil {
+
+		return session, nil
+
+	}
+
+	if e = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); e != nil {
+
+		session.ID = ""
+
+		return session, e
+
+	}
+
+	data, e := s.backend.load(session.ID)
+
+	if e == nil {
+
+		e = securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...)
+
+	}
+
+	if e != nil {
+
+		// the session is gone, a new one with a new ID is created on save
+		session.ID = ""
+
+		return session, e
+
+	}
+
+	session.IsNew = false
+
+	return session, nil
+
+}
+
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+
+	if session.Options.MaxAge <= 0 {
+
+		if session.ID != "" {
+
+			if e := s.backend.delete(session.ID); e != nil {
+
+				return e
+
+			}
+
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+
+		return nil
+
+	}
+
+	if session.ID == "" {
+
+		session.ID = newSessionID()
+
+	}
+
+	data, e := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+
+	if e != nil {
+
+		return e
+
+	}
+
+	if e = s.backend.save(session.ID, data, time.Duration(session.Options.MaxAge)*time.Second); e != nil {
+
+		return e
+
+	}
+
+	encoded, e := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+
+	if e != nil {
+
+		return e
+
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+
+}
+
+func (s *serverStore) Delete(id string) error {
+
+	return s.backend.delete(id)
+
+}
+
+func (s *serverStore) Exists(id string) (bool, error) {
+
+	return s.backend.exists(id)
+
+}
+
+func (s *serverStore) Load(id string) (map[interface{}]interface{}, error) {
+
+	data, e := s.backend.load(id)
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	values := make(map[interface{}]interface{})
+
+	if e = securecookie.DecodeMulti(sessionName, data, &values, s.Codecs...); e != nil {
+
+		return nil, e
+
+	}
+
+	return values, nil
+
+}
+
+// Close closes the backend if it holds connections, eg to redis
+func (s *serverStore) Close() error {
+
+	if c, ok := s.backend.(io.Closer); ok {
+
+		return c.Close()
+
+	}
+
+	return nil
+
+}
+
+// memoryBackend ----------------------------------------------------------------
+
+type memoryEntry struct {
+	data    string
+	expires time.Time
+}
+
+// memoryBackend keeps the sessions in memory; sessions are lost on restart and are
+// not shared between portal instances, which makes it mostly useful for development
+type memoryBackend struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastPrune time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+
+	return &memoryBackend{entries: make(map[string]memoryEntry)}
+
+}
+
+func (b *memoryBackend) load(id string) (string, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, exists := b.entries[id]
+
+	if !exists || entry.expires.Before(time.Now()) {
+
+		return "", errSessionNotFound
+
+	}
+
+	return entry.data, nil
+
+}
+
+func (b *memoryBackend) save(id string, data string, ttl time.Duration) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	// expired sessions are dropped once a minute at most
+	if now.Sub(b.lastPrune) > time.Minute {
+
+		for k, entry := range b.entries {
+
+			if entry.expires.Before(now) {
+
+				delete(b.entries, k)
+
+			}
+
+		}
+
+		b.lastPrune = now
+
+	}
+
+	b.entries[id] = memoryEntry{data: data, expires: now.Add(ttl)}
+
+	return nil
+
+}
+
+func (b *memoryBackend) delete(id string) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, id)
+
+	return nil
+
+}
+
+func (b *memoryBackend) exists(id string) (bool, error) {
+
+	_, e := b.load(id)
+
+	return e == nil, nil
+
+}
+
+// newPortalStore creates the session store and index for the configured backend,
+// with the given default options for the session cookies
+func newPortalStore(c sessionConfig, options *sessions.Options, keyPairs ...[]byte) (s portalStore, i sessionIndex, returnErr error) {
+
+	switch c.Backend {
+
+	case backendFilesystem:
+
+		os.Mkdir(sessionDir, 0744)
+
+		fs := newFilesystemStore(sessionDir, keyPairs...)
+
+		fs.Options = options
+		fs.MaxLength(1048576) // 1MB
+
+		s, i = fs, newLocalSessionIndex(filepath.Join(sessionDir, "index.json"))
+
+	case backendCookie:
+
+		// the tokens of the sessions are kept in the token vault, see validateConfig
+		cs := newCookieStore(keyPairs...)
+
+		cs.Options = options
+
+		s, i = cs, newLocalSessionIndex("")
+
+	case backendMemory:
+
+		ss := newServerStore(newMemoryBackend(), keyPairs...)
+
+		ss.Options = options
+		ss.MaxLength(1048576) // 1MB
+
+		s, i = ss, newLocalSessionIndex("")
+
+	case backendRedis:
+
+		rb, e := newRedisBackend(c)
+
+		if e != nil {
+
+			returnErr = e
+
+			return
+
+		}
+
+		ss := newServerStore(rb, keyPairs...)
+
+		ss.Options = options
+		ss.MaxLength(1048576) // 1MB
+
+		s, i = ss, newRedisSessionIndex(rb)
+
+	default:
+
+		returnErr = fmt.Errorf("unknown session backend %q", c.Backend)
+
+	}
+
+	return
+
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/sessions"
+)
+
+const testHashKey = "0123456789abcdef0123456789abcdef"
+
+// newTestServerStore creates a server store on the backend with the options the
+// portal uses
+func newTestServerStore(b sessionBackend) *serverStore {
+
+	s := newServerStore(b, []byte(testHashKey))
+
+	s.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   3600,
+		HttpOnly: true,
+	}
+
+	return s
+
+}
+
+// requestWithCookies returns a request carrying the cookies set in a response
+func requestWithCookies(w *httptest.ResponseRecorder) *http.Request {
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	for _, c := range w.Result().Cookies() {
+
+		r.AddCookie(c)
+
+	}
+
+	return r
+
+}
+
+// saveTestSession saves a new session with a value in the store and returns the
+// response carrying its cookie
+func saveTestSession(t *testing.T, s portalStore) (*sessions.Session, *httptest.ResponseRecorder) {
+
+	t.Helper()
+
+	session, e := s.New(httptest.NewRequest(http.MethodGet, "/", nil), sessionName)
+
+	if e != nil || !session.IsNew {
+
+		t.Fatalf("New without a cookie = %v, new %v; want a new session", e, session.IsNew)
+
+	}
+
+	session.Values["user"] = "alice"
+
+	w := httptest.NewRecorder()
+
+	if e := session.Save(httptest.NewRequest(http.MethodGet, "/", nil), w); e != nil {
+
+		t.Fatalf("Save: %v", e)
+
+	}
+
+	if session.ID == "" {
+
+		t.Fatal("Save did not assign a session ID")
+
+	}
+
+	return session, w
+
+}
+
+func TestServerStoreRoundTrip(t *testing.T) {
+
+	s := newTestServerStore(newMemoryBackend())
+
+	saved, w := saveTestSession(t, s)
+
+	loaded, e := s.New(requestWithCookies(w), sessionName)
+
+	if e != nil {
+
+		t.Fatalf("New with the cookie: %v", e)
+
+	}
+
+	if loaded.IsNew || loaded.ID != saved.ID || loaded.Values["user"] != "alice" {
+
+		t.Fatalf("loaded session %v (new %v) with %v, want %v with user alice", loaded.ID, loaded.IsNew, loaded.Values, saved.ID)
+
+	}
+
+	values, e := s.Load(saved.ID)
+
+	if e != nil || values["user"] != "alice" {
+
+		t.Fatalf("Load = %v, %v; want the saved values", values, e)
+
+	}
+
+}
+
+func TestServerStoreDeleteAndExists(t *testing.T) {
+
+	s := newTestServerStore(newMemoryBackend())
+
+	saved, w := saveTestSession(t, s)
+
+	if exists, e := s.Exists(saved.ID); !exists || e != nil {
+
+		t.Fatalf("Exists of a saved session = %v, %v", exists, e)
+
+	}
+
+	if e := s.Delete(saved.ID); e != nil {
+
+		t.Fatalf("Delete: %v", e)
+
+	}
+
+	if exists, _ := s.Exists(saved.ID); exists {
+
+		t.Fatal("the session exists after Delete")
+
+	}
+
+	if e := s.Delete(saved.ID); e != nil {
+
+		t.Fatalf("Delete of a missing session: %v", e)
+
+	}
+
+	loaded, _ := s.New(requestWithCookies(w), sessionName)
+
+	if !loaded.IsNew || loaded.ID != "" || len(loaded.Values) != 0 {
+
+		t.Fatalf("the cookie of a deleted session loaded session %v with %v", loaded.ID, loaded.Values)
+
+	}
+
+	if _, e := s.Load(saved.ID); e != errSessionNotFound {
+
+		t.Fatalf("Load of a deleted session = %v, want errSessionNotFound", e)
+
+	}
+
+}
+
+func TestServerStoreTTL(t *testing.T) {
+
+	s := newTestServerStore(newMemoryBackend())
+
+	s.Options.MaxAge = 1
+
+	saved, w := saveTestSession(t, s)
+
+	if exists, _ := s.Exists(saved.ID); !exists {
+
+		t.Fatal("the session does not exist before its max age")
+
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if exists, _ := s.Exists(saved.ID); exists {
+
+		t.Fatal("the session exists after its max age")
+
+	}
+
+	if loaded, _ := s.New(requestWithCookies(w), sessionName); !loaded.IsNew {
+
+		t.Fatal("an expired session was loaded")
+
+	}
+
+}
+
+func TestServerStoreMaxAgeDeletes(t *testing.T) {
+
+	s := newTestServerStore(newMemoryBackend())
+
+	saved, w := saveTestSession(t, s)
+
+	session, _ := s.New(requestWithCookies(w), sessionName)
+
+	session.Options.MaxAge = -1
+
+	w = httptest.NewRecorder()
+
+	if e := session.Save(httptest.NewRequest(http.MethodGet, "/", nil), w); e != nil {
+
+		t.Fatalf("Save with MaxAge -1: %v", e)
+
+	}
+
+	if exists, _ := s.Exists(saved.ID); exists {
+
+		t.Fatal("the session exists after a save with MaxAge -1")
+
+	}
+
+	cookies := w.Result().Cookies()
+
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+
+		t.Fatalf("cookies after a save with MaxAge -1 = %v, want one deleting the session cookie", cookies)
+
+	}
+
+}
+
+func TestRedisBackend(t *testing.T) {
+
+	mr, e := miniredis.Run()
+
+	if e != nil {
+
+		t.Fatalf("starting miniredis: %v", e)
+
+	}
+
+	defer mr.Close()
+
+	b, e := newRedisBackend(sessionConfig{RedisAddress: mr.Addr(), RedisKeyPrefix: "test:"})
+
+	if e != nil {
+
+		t.Fatalf("newRedisBackend: %v", e)
+
+	}
+
+	defer b.Close()
+
+	s := newTestServerStore(b)
+
+	saved, _ := saveTestSession(t, s)
+
+	key := "test:session:" + saved.ID
+
+	if !mr.Exists(key) {
+
+		t.Fatalf("no redis key %v, keys are %v", key, mr.Keys())
+
+	}
+
+	if ttl := mr.TTL(key); ttl != time.Hour {
+
+		t.Fatalf("ttl of %v = %v, want the max age of the session", key, ttl)
+
+	}
+
+	tokens := b.withNamespace("tokens")
+
+	if e := tokens.save(saved.ID, "sealed", time.Minute); e != nil {
+
+		t.Fatalf("save in the tokens namespace: %v", e)
+
+	}
+
+	if !mr.Exists("test:tokens:" + saved.ID) {
+
+		t.Fatalf("no key in the tokens namespace, keys are %v", mr.Keys())
+
+	}
+
+	mr.FastForward(time.Hour)
+
+	if exists, _ := s.Exists(saved.ID); exists {
+
+		t.Fatal("the session exists in redis after its ttl")
+
+	}
+
+	if _, e := b.load(saved.ID); e != errSessionNotFound {
+
+		t.Fatalf("load of an expired session = %v, want errSessionNotFound", e)
+
+	}
+
+}
+
+func TestRedisSessionIndex(t *testing.T) {
+
+	mr, e := miniredis.Run()
+
+	if e != nil {
+
+		t.Fatalf("starting miniredis: %v", e)
+
+	}
+
+	defer mr.Close()
+
+	b, e := newRedisBackend(sessionConfig{RedisAddress: mr.Addr(), RedisKeyPrefix: "test:"})
+
+	if e != nil {
+
+		t.Fatalf("newRedisBackend: %v", e)
+
+	}
+
+	defer b.Close()
+
+	i := newRedisSessionIndex(b)
+
+	b.save("live", "session", time.Hour)
+	b.save("expiring", "session", time.Minute)
+
+	for _, id := range []string{"live", "expiring"} {
+
+		if e := i.Add(SessionRecord{ID: id, KeycloakID: "alice-id", Created: 100, LastSeen: 100}); e != nil {
+
+			t.Fatalf("Add: %v", e)
+
+		}
+
+	}
+
+	if e := i.Touch("live", 200); e != nil {
+
+		t.Fatalf("Touch: %v", e)
+
+	}
+
+	// touching a removed record does not bring it back
+	i.Remove("expiring")
+
+	if e := i.Touch("expiring", 200); e != nil || mr.HGet("test:index", "expiring") != "" {
+
+		t.Fatalf("Touch of a removed record = %v, record %q", e, mr.HGet("test:index", "expiring"))
+
+	}
+
+	i.Add(SessionRecord{ID: "expiring", KeycloakID: "alice-id", Created: 100, LastSeen: 100})
+
+	mr.FastForward(2 * time.Minute)
+
+	recs, e := i.Find(func(rec SessionRecord) bool { return rec.KeycloakID == "alice-id" })
+
+	if e != nil || len(recs) != 1 || recs[0].ID != "live" || recs[0].Created != 100 || recs[0].LastSeen != 200 {
+
+		t.Fatalf("Find = %+v, %v; want the live session, last seen at 200", recs, e)
+
+	}
+
+	if fields, _ := mr.HKeys("test:index"); len(fields) != 1 {
+
+		t.Fatalf("index records after Find = %v, want the record of the expired session dropped", fields)
+
+	}
+
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// a request may be rewriting a session file while the sweeper reads it, which then
+// cannot be decoded; files are only taken as orphans once they have not been saved
+// for this many sweep intervals
+const orphanGraceSweeps = 3
+
+// sweepResult reports what a sweep of the session directory did
+type sweepResult struct {
+	Expired  int   // sessions past their max age
+	Orphaned int   // files which cannot be decoded or are left overs of the index
+	Evicted  int   // oldest sessions removed to get under the disk usage cap
+	Bytes    int64 // disk space used by the remaining session files
+}
+
+// sessionFileInfo describes a session file found by the sweeper
+type sessionFileInfo struct {
+	id      string
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// sessionSweeper is the background task started by startSessionSweeper
+type sessionSweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startSessionSweeper periodically removes the files of expired and orphaned
+// sessions from the directory of a filesystem store, keeping the disk usage under
+// maxUsage bytes (0 means no cap)
+func startSessionSweeper(fs *filesystemStore, interval time.Duration, maxUsage int64) *sessionSweeper {
+
+	l.Info.Printf("[SWEEPER] Sweeping session directory %v every %v\n", fs.dir, interval)
+
+	s := &sessionSweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+
+			select {
+
+			case <-s.stop:
+
+				return
+
+			case <-ticker.C:
+
+			}
+
+			res, e := fs.sweep(time.Now(), orphanGraceSweeps*interval, maxUsage)
+
+			if e != nil {
+
+				l.Warning.Printf("[SWEEPER] Error sweeping session directory: %v\n", e)
+
+			}
+
+			l.Info.Printf("[SWEEPER] Removed %v session files (%v expired, %v orphaned, %v over the disk cap), %v bytes in use\n",
+				res.Expired+res.Orphaned+res.Evicted, res.Expired, res.Orphaned, res.Evicted, res.Bytes)
+
+		}
+
+	}()
+
+	return s
+
+}
+
+// Stop stops the sweeper, waiting for a sweep in progress to complete
+func (s *sessionSweeper) Stop() {
+
+	close(s.stop)
+
+	<-s.done
+
+}
+
+// sweep removes from the store's directory the session files which expired, the
+// ones which cannot be decoded any more (eg written with a key that is no longer
+// configured) and have not been saved within the grace period, and temporary files
+// left behind by the session index; if the remaining files take more than maxUsage
+// bytes, the least recently saved sessions are removed as well. Index records of the
+// removed sessions are dropped.
+func (s *filesystemStore) sweep(now time.Time, grace time.Duration, maxUsage int64) (res sweepResult, returnErr error) {
+
+	entries, e := ioutil.ReadDir(s.dir)
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	// the gorilla store rewrites the file on each save, which also renews the cookie
+	maxAge := time.Duration(s.Options.MaxAge) * time.Second
+
+	var live []sessionFileInfo
+
+	for _, entry := range entries {
+
+		path := filepath.Join(s.dir, entry.Name())
+
+		switch {
+
+		case entry.IsDir():
+
+			continue
+
+		case strings.HasPrefix(entry.Name(), ".index-"):
+
+			if now.Sub(entry.ModTime()) > time.Hour && os.Remove(path) == nil {
+
+				res.Orphaned++
+
+			}
+
+			continue
+
+		case !strings.HasPrefix(entry.Name(), "session_"):
+
+			continue
+
+		}
+
+		f := sessionFileInfo{
+			id:      strings.TrimPrefix(entry.Name(), "session_"),
+			path:    path,
+			size:    entry.Size(),
+			modTime: entry.ModTime(),
+		}
+
+		if now.Sub(f.modTime) > maxAge {
+
+			if s.removeSessionFile(f) {
+
+				res.Expired++
+
+			}
+
+			continue
+
+		}
+
+		// the gorilla store does not lock the file against readers while it rewrites
+		// it, so a recently saved file is kept even if it cannot be decoded
+		if now.Sub(f.modTime) > grace && !s.decodable(f) {
+
+			if s.removeSessionFile(f) {
+
+				res.Orphaned++
+
+			}
+
+			continue
+
+		}
+
+		live = append(live, f)
+
+		res.Bytes += f.size
+
+	}
+
+	if maxUsage <= 0 || res.Bytes <= maxUsage {
+
+		return
+
+	}
+
+	sort.Slice(live, func(i, j int) bool { return live[i].modTime.Before(live[j].modTime) })
+
+	for _, f := range live {
+
+		if res.Bytes <= maxUsage {
+
+			break
+
+		}
+
+		if s.removeSessionFile(f) {
+
+			res.Evicted++
+
+			res.Bytes -= f.size
+
+		}
+
+	}
+
+	return
+
+}
+
+// decodable tells whether a session file can still be decoded with the codecs of
+// the store
+func (s *filesystemStore) decodable(f sessionFileInfo) bool {
+
+	data, e := ioutil.ReadFile(f.path)
+
+	if e != nil {
+
+		// the session may just have been removed, it is not ours to judge
+		return true
+
+	}
+
+	values := make(map[interface{}]interface{})
+
+	return securecookie.DecodeMulti(sessionName, string(data), &values, s.Codecs...) == nil
+
+}
+
+// removeSessionFile removes a session file and its index record
+func (s *filesystemStore) removeSessionFile(f sessionFileInfo) bool {
+
+	if e := os.Remove(f.path); e != nil && !os.IsNotExist(e) {
+
+		l.Warning.Printf("[SWEEPER] Error removing session file %v: %v\n", f.path, e)
+
+		return false
+
+	}
+
+	if vault != nil {
+
+		if e := vault.remove(f.id); e != nil {
+
+			l.Warning.Printf("[SWEEPER] Error removing the tokens of session %v from the vault: %v\n", f.id, e)
+
+		}
+
+	}
+
+	if e := index.Remove(f.id); e != nil {
+
+		l.Warning.Printf("[SWEEPER] Error removing session %v from the index: %v\n", f.id, e)
+
+	}
+
+	return true
+
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestFilesystemStore creates a filesystem store in a temporary directory
+func newTestFilesystemStore(t *testing.T) *filesystemStore {
+
+	t.Helper()
+
+	index = newLocalSessionIndex("")
+
+	fs := newFilesystemStore(t.TempDir(), []byte(testHashKey))
+
+	fs.Options.MaxAge = 3600
+
+	return fs
+
+}
+
+func TestSweepKeepsRecentUndecodableFiles(t *testing.T) {
+
+	fs := newTestFilesystemStore(t)
+
+	file := fs.sessionFile("partial")
+
+	ioutil.WriteFile(file, []byte("MTYx"), 0600)
+
+	if res, e := fs.sweep(time.Now(), time.Hour, 0); e != nil || res.Orphaned != 0 {
+
+		t.Fatalf("sweep of a recently saved file = %+v, %v; want it kept", res, e)
+
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	os.Chtimes(file, old, old)
+
+	// older than the grace period but not expired
+	fs.Options.MaxAge = 3 * 3600
+
+	if res, e := fs.sweep(time.Now(), time.Hour, 0); e != nil || res.Orphaned != 1 {
+
+		t.Fatalf("sweep of an undecodable file older than the grace period = %+v, %v; want it removed", res, e)
+
+	}
+
+	if _, e := os.Stat(file); !os.IsNotExist(e) {
+
+		t.Fatalf("the orphaned file still exists: %v", e)
+
+	}
+
+}
+
+func TestSweepWhileSessionIsRewritten(t *testing.T) {
+
+	fs := newTestFilesystemStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s, _ := fs.New(r, sessionName)
+
+	s.Values["user"] = "alice"
+
+	if e := s.Save(r, httptest.NewRecorder()); e != nil {
+
+		t.Fatalf("Save: %v", e)
+
+	}
+
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+
+	wg.Add(1)
+
+	// requests of the user keep saving the session
+	go func() {
+
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+
+			select {
+
+			case <-stop:
+
+				return
+
+			default:
+
+			}
+
+			s.Values["count"] = i
+
+			s.Save(r, httptest.NewRecorder())
+
+		}
+
+	}()
+
+	for i := 0; i < 200; i++ {
+
+		if res, e := fs.sweep(time.Now(), time.Minute, 0); e != nil || res.Orphaned != 0 {
+
+			close(stop)
+
+			wg.Wait()
+
+			t.Fatalf("sweep while the session is saved = %+v, %v; want the session kept", res, e)
+
+		}
+
+	}
+
+	close(stop)
+
+	wg.Wait()
+
+	if values, e := fs.Load(s.ID); e != nil || values["user"] != "alice" {
+
+		t.Fatalf("Load after the sweeps = %v, %v; want the session", values, e)
+
+	}
+
+}
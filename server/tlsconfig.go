@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// tlsVersions maps the minimum tls versions accepted in the configuration to the
+// crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSClientConfig creates the tls configuration used when connecting to upstream
+// services: the system roots are extended with the configured CA bundle, the client
+// certificate is presented for mutual tls and certificate verification is only
+// skipped if the upstream is explicitly marked as insecure
+func newTLSClientConfig(c tlsConfig, insecure bool) (returnConfig *tls.Config, returnErr error) {
+
+	minVersion, exists := tlsVersions[c.MinVersion]
+
+	if !exists {
+
+		returnErr = fmt.Errorf("unsupported minimum tls version %q", c.MinVersion)
+
+		return
+
+	}
+
+	returnConfig = &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: insecure,
+	}
+
+	if c.CABundle != "" {
+
+		pool, e := x509.SystemCertPool()
+
+		if e != nil {
+
+			pool = x509.NewCertPool()
+
+		}
+
+		pem, e := ioutil.ReadFile(c.CABundle)
+
+		if e != nil {
+
+			returnErr = fmt.Errorf("unable to read CA bundle - %v", e)
+
+			return
+
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+
+			returnErr = fmt.Errorf("no certificates found in CA bundle %v", c.CABundle)
+
+			return
+
+		}
+
+		returnConfig.RootCAs = pool
+
+	}
+
+	if c.ClientCertificate != "" || c.ClientKey != "" {
+
+		if c.ClientCertificate == "" || c.ClientKey == "" {
+
+			returnErr = errors.New("both a client certificate and a client key are needed for mutual tls")
+
+			return
+
+		}
+
+		cert, e := tls.LoadX509KeyPair(c.ClientCertificate, c.ClientKey)
+
+		if e != nil {
+
+			returnErr = fmt.Errorf("unable to load client certificate - %v", e)
+
+			return
+
+		}
+
+		returnConfig.Certificates = []tls.Certificate{cert}
+
+	}
+
+	return
+
+}
+
+// newTransport creates an http transport for talking to an upstream service with
+// the tls configuration above; the default transport is left untouched
+func newTransport(c tlsConfig, insecure bool) (*http.Transport, error) {
+
+	tlsConfig, e := newTLSClientConfig(c, insecure)
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+
+}
+
+// newHTTPClient creates an http client using a transport from newTransport
+func newHTTPClient(c tlsConfig, insecure bool) (*http.Client, error) {
+
+	transport, e := newTransport(c, insecure)
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	return &http.Client{Transport: transport}, nil
+
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	l "gitlab.com/cyclops-utilities/logging"
+)
+
+// parameters of the token exchange grant (RFC 8693)
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+const (
+	tokenEndpointPath   = "/auth/token"
+	exchangePrunePeriod = time.Minute // expired exchanged tokens are dropped from the cache at most this often
+)
+
+// AudienceToken is an access token restricted to an audience, as returned by the
+// token endpoint of the portal
+type AudienceToken struct {
+	AccessToken string `json:"access_token"`
+	Audience    string `json:"audience"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// tokenExchangeError is the error response of keycloak to a token exchange
+type tokenExchangeError struct {
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *tokenExchangeError) Error() string {
+
+	return fmt.Sprintf("token exchange rejected with status %v: %v %v", e.Status, e.Code, e.Description)
+
+}
+
+// exchangedToken is a token obtained by a token exchange
+type exchangedToken struct {
+	accessToken string
+	expiry      time.Time
+}
+
+// exchangeCache keeps the tokens obtained by token exchange until they expire. The
+// tokens are keyed by a hash of the access token of the session they were exchanged
+// from, so that a session gets new ones once its own token is refreshed, and they
+// are forgotten when the session ends.
+type exchangeCache struct {
+	mu         sync.Mutex
+	tokens     map[string]map[string]exchangedToken
+	lastPruned time.Time
+}
+
+func newExchangeCache() *exchangeCache {
+
+	return &exchangeCache{
+		tokens:     make(map[string]map[string]exchangedToken),
+		lastPruned: time.Now(),
+	}
+
+}
+
+// tokenHash returns a hash of a token, which keys the caches of what is derived
+// from it without keeping the token itself around
+func tokenHash(token string) string {
+
+	h := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(h[:])
+
+}
+
+// get returns a cached token for the audience which does not expire within the
+// refresh margin
+func (c *exchangeCache) get(subjectToken, audience string) (t exchangedToken, found bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, found = c.tokens[tokenHash(subjectToken)][audience]
+
+	return t, found && time.Until(t.expiry) > tokenRefreshMargin
+
+}
+
+// put caches a token for the audience and drops the expired ones
+func (c *exchangeCache) put(subjectToken, audience string, t exchangedToken) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := tokenHash(subjectToken)
+
+	if c.tokens[key] == nil {
+
+		c.tokens[key] = make(map[string]exchangedToken)
+
+	}
+
+	c.tokens[key][audience] = t
+
+	if time.Since(c.lastPruned) < exchangePrunePeriod {
+
+		return
+
+	}
+
+	for k, byAudience := range c.tokens {
+
+		for a, t := range byAudience {
+
+			if time.Now().After(t.expiry) {
+
+				delete(byAudience, a)
+
+			}
+
+		}
+
+		if len(byAudience) == 0 {
+
+			delete(c.tokens, k)
+
+		}
+
+	}
+
+	c.lastPruned = time.Now()
+
+}
+
+// forget drops the tokens exchanged from a session's access token
+func (c *exchangeCache) forget(subjectToken string) {
+
+	if subjectToken == "" {
+
+		return
+
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, tokenHash(subjectToken))
+
+}
+
+// audienceToken returns an access token for the audience exchanged from the access
+// token of a session, from the cache if a valid one has already been obtained
+func audienceToken(ctx context.Context, subjectToken, audience string) (t exchangedToken, returnErr error) {
+
+	if t, found := exchanges.get(subjectToken, audience); found {
+
+		return t, nil
+
+	}
+
+	t, returnErr = exchangeToken(ctx, subjectToken, audience)
+
+	if returnErr != nil {
+
+		return
+
+	}
+
+	exchanges.put(subjectToken, audience, t)
+
+	return
+
+}
+
+// exchangeToken asks keycloak to exchange an access token for one restricted to the
+// audience (RFC 8693); the portal authenticates with its client credentials, so the
+// client must be allowed to exchange tokens for the audience in keycloak
+func exchangeToken(ctx context.Context, subjectToken, audience string) (t exchangedToken, returnErr error) {
+
+	form := url.Values{
+		"grant_type":           {grantTypeTokenExchange},
+		"client_id":            {cfg.Keycloak.ClientID},
+		"client_secret":        {cfg.Keycloak.ClientSecret},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeAccessToken},
+		"audience":             {audience},
+	}
+
+	req, e := http.NewRequestWithContext(ctx, http.MethodPost, Oauth2Config.Endpoint.TokenURL, strings.NewReader(form.Encode()))
+
+	if e != nil {
+
+		returnErr = fmt.Errorf("unable to create the token exchange request - %w", e)
+
+		return
+
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, e := KeycloakHTTPClient.Do(req)
+
+	if e != nil {
+
+		returnErr = fmt.Errorf("unable to reach the token endpoint - %w", e)
+
+		return
+
+	}
+
+	defer resp.Body.Close()
+
+	body, e := ioutil.ReadAll(resp.Body)
+
+	if e != nil {
+
+		returnErr = fmt.Errorf("unable to read the token exchange response - %w", e)
+
+		return
+
+	}
+
+	if resp.StatusCode != http.StatusOK {
+
+		te := &tokenExchangeError{Status: resp.StatusCode}
+
+		json.Unmarshal(body, te)
+
+		returnErr = te
+
+		return
+
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if e := json.Unmarshal(body, &tr); e != nil || tr.AccessToken == "" {
+
+		returnErr = fmt.Errorf("invalid token exchange response - %v", e)
+
+		return
+
+	}
+
+	t = exchangedToken{
+		accessToken: tr.AccessToken,
+		expiry:      time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}
+
+	l.Debug.Printf("[TOKEN] Exchanged a token for audience %v, expiring in %vs\n", audience, tr.ExpiresIn)
+
+	return
+
+}
+
+// isExchangeRejected tells whether a token exchange failed because keycloak refused
+// it (eg the exchange is not permitted for the audience), rather than because it
+// could not be reached
+func isExchangeRejected(e error) bool {
+
+	te, ok := e.(*tokenExchangeError)
+
+	return ok && te.Status < http.StatusInternalServerError
+
+}
+
+// audienceAllowed tells whether tokens for the audience can be obtained through the
+// token endpoint
+func audienceAllowed(audience string) bool {
+
+	for _, a := range cfg.Keycloak.TokenExchangeAudiences {
+
+		if a == audience {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+// tokenEndpoint serves GET /auth/token?audience=<audience>, which returns an access
+// token for the audience exchanged from the token of the session; only the audiences
+// listed in keycloak.tokenexchangeaudiences can be requested
+func tokenEndpoint(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if len(cfg.Keycloak.TokenExchangeAudiences) == 0 {
+
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "the token endpoint is not enabled")
+
+		return
+
+	}
+
+	if r.Method != http.MethodGet {
+
+		w.Header().Set("Allow", "GET")
+
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "the token endpoint only accepts GET requests")
+
+		return
+
+	}
+
+	audience := r.URL.Query().Get("audience")
+
+	if audience == "" {
+
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "an audience must be given")
+
+		return
+
+	}
+
+	if !audienceAllowed(audience) {
+
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "tokens for this audience cannot be requested")
+
+		return
+
+	}
+
+	s, e := store.Get(r, sessionName)
+
+	if e != nil {
+
+		l.Warning.Printf("[TOKEN] Error getting session: %v\n", e)
+
+	}
+
+	if !keepSessionAlive(w, r, s) || !ensureFreshToken(w, r, s) {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session is not authenticated or has expired")
+
+		return
+
+	}
+
+	subjectToken := getSessionTokens(s).AccessToken
+
+	if subjectToken == "" {
+
+		writeJSONError(w, http.StatusUnauthorized, errCodeNotAuthenticated, "the session has no access token")
+
+		return
+
+	}
+
+	t, e := audienceToken(keycloakContext(r.Context()), subjectToken, audience)
+
+	if e != nil {
+
+		writeExchangeError(w, audience, e)
+
+		return
+
+	}
+
+	writeJSON(w, http.StatusOK, AudienceToken{
+		AccessToken: t.accessToken,
+		Audience:    audience,
+		ExpiresIn:   int64(time.Until(t.expiry).Seconds()),
+		TokenType:   "Bearer",
+	})
+
+}
+
+// writeExchangeError answers a request for which no token could be exchanged
+func writeExchangeError(w http.ResponseWriter, audience string, e error) {
+
+	if isExchangeRejected(e) {
+
+		l.Warning.Printf("[TOKEN] Token exchange for audience %v rejected: %v\n", audience, e)
+
+		writeJSONError(w, http.StatusForbidden, errCodeTokenExchangeDenied, "no token can be obtained for "+audience)
+
+		return
+
+	}
+
+	l.Error.Printf("[TOKEN] Token exchange for audience %v failed: %v\n", audience, e)
+
+	writeJSONError(w, http.StatusBadGateway, errCodeProviderUnavailable, "the identity provider could not be reached")
+
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionTokens are the tokens obtained from the openid provider for a session
+type sessionTokens struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenVault keeps the tokens of the sessions on the server side, encrypted with
+// AES-GCM and keyed by session ID, so that they never reach the browser; the session
+// ID is authenticated together with the tokens, so the tokens of a session cannot
+// be used for another one. The vault uses the same kind of storage as the sessions.
+type tokenVault struct {
+	aead    cipher.AEAD
+	backend sessionBackend
+	ttl     time.Duration
+}
+
+// newTokenVault creates a vault encrypting with the given key (16, 24 or 32 bytes)
+// next to the sessions of the store
+func newTokenVault(key []byte, s portalStore, ttl time.Duration) (*tokenVault, error) {
+
+	block, e := aes.NewCipher(key)
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	aead, e := cipher.NewGCM(block)
+
+	if e != nil {
+
+		return nil, e
+
+	}
+
+	v := &tokenVault{
+		aead: aead,
+		ttl:  ttl,
+	}
+
+	switch st := s.(type) {
+
+	case *filesystemStore:
+
+		v.backend = newFileBackend(filepath.Join(st.dir, "tokens"), ttl)
+
+	case *serverStore:
+
+		if rb, ok := st.backend.(*redisBackend); ok {
+
+			v.backend = rb.withNamespace("tokens")
+
+		} else {
+
+			v.backend = newMemoryBackend()
+
+		}
+
+	case *cookieStore:
+
+		v.backend = newFileBackend(filepath.Join(sessionDir, "tokens"), ttl)
+
+	default:
+
+		return nil, fmt.Errorf("the token vault is not supported by a %T", s)
+
+	}
+
+	return v, nil
+
+}
+
+// get returns the tokens of a session, or errSessionNotFound
+func (v *tokenVault) get(id string) (t sessionTokens, returnErr error) {
+
+	data, e := v.backend.load(id)
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	sealed, e := base64.RawURLEncoding.DecodeString(data)
+
+	if e != nil || len(sealed) < v.aead.NonceSize() {
+
+		returnErr = errors.New("invalid token vault entry")
+
+		return
+
+	}
+
+	nonce, sealed := sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():]
+
+	plain, e := v.aead.Open(nil, nonce, sealed, []byte(id))
+
+	if e != nil {
+
+		returnErr = e
+
+		return
+
+	}
+
+	returnErr = json.Unmarshal(plain, &t)
+
+	return
+
+}
+
+// put stores the tokens of a session, replacing the ones already stored
+func (v *tokenVault) put(id string, t sessionTokens) error {
+
+	plain, e := json.Marshal(t)
+
+	if e != nil {
+
+		return e
+
+	}
+
+	nonce := make([]byte, v.aead.NonceSize())
+
+	if _, e = io.ReadFull(rand.Reader, nonce); e != nil {
+
+		return e
+
+	}
+
+	sealed := v.aead.Seal(nonce, nonce, plain, []byte(id))
+
+	return v.backend.save(id, base64.RawURLEncoding.EncodeToString(sealed), v.ttl)
+
+}
+
+// remove removes the tokens of a session; removing tokens which are not in the vault
+// is not an error
+func (v *tokenVault) remove(id string) error {
+
+	return v.backend.delete(id)
+
+}
+
+// fileBackend keeps the entries of the token vault in files in a directory, one file
+// per session; entries older than the ttl are treated as gone, their files are
+// removed from time to time as new entries are saved
+type fileBackend struct {
+	dir string
+	ttl time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func newFileBackend(dir string, ttl time.Duration) *fileBackend {
+
+	os.MkdirAll(dir, 0700)
+
+	return &fileBackend{
+		dir: dir,
+		ttl: ttl,
+	}
+
+}
+
+func (b *fileBackend) file(id string) string {
+
+	return filepath.Join(b.dir, id)
+
+}
+
+func (b *fileBackend) load(id string) (string, error) {
+
+	info, e := os.Stat(b.file(id))
+
+	if os.IsNotExist(e) || (e == nil && time.Since(info.ModTime()) > b.ttl) {
+
+		return "", errSessionNotFound
+
+	}
+
+	data, e := ioutil.ReadFile(b.file(id))
+
+	if os.IsNotExist(e) {
+
+		return "", errSessionNotFound
+
+	}
+
+	return string(data), e
+
+}
+
+func (b *fileBackend) save(id string, data string, ttl time.Duration) error {
+
+	b.prune()
+
+	return ioutil.WriteFile(b.file(id), []byte(data), 0600)
+
+}
+
+// prune removes the files of the expired entries, at most once per minute; with the
+// cookie backend, nothing else removes the entries of sessions which just expire
+func (b *fileBackend) prune() {
+
+	b.mu.Lock()
+
+	if time.Since(b.lastPrune) < time.Minute {
+
+		b.mu.Unlock()
+
+		return
+
+	}
+
+	b.lastPrune = time.Now()
+
+	b.mu.Unlock()
+
+	entries, e := ioutil.ReadDir(b.dir)
+
+	if e != nil {
+
+		return
+
+	}
+
+	for _, info := range entries {
+
+		if !info.IsDir() && time.Since(info.ModTime()) > b.ttl {
+
+			os.Remove(filepath.Join(b.dir, info.Name()))
+
+		}
+
+	}
+
+}
+
+func (b *fileBackend) delete(id string) error {
+
+	if e := os.Remove(b.file(id)); e != nil && !os.IsNotExist(e) {
+
+		return e
+
+	}
+
+	return nil
+
+}
+
+func (b *fileBackend) exists(id string) (bool, error) {
+
+	_, e := b.load(id)
+
+	if e == errSessionNotFound {
+
+		return false, nil
+
+	}
+
+	return e == nil, e
+
+}